@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sendRequest is the JSON body accepted by POST /api/send.
+type sendRequest struct {
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Cc          []string            `json:"cc"`
+	Subject     string              `json:"subject"`
+	Body        string              `json:"body"`
+	ContentType string              `json:"content_type"` // "text" (default) or "html"
+	Attachments []sendRequestAttach `json:"attachments"`
+}
+
+type sendRequestAttach struct {
+	Name          string `json:"name"`
+	ContentType   string `json:"content_type"`
+	ContentBase64 string `json:"content_base64"`
+}
+
+func registerAPIRoutes(mux *http.ServeMux, b *Backend) {
+	mux.HandleFunc("/api/send", b.requireAPIKey(b.handleAPISend))
+	mux.HandleFunc("/admin/maintenance", b.requireAPIKey(b.handleMaintenance))
+	mux.HandleFunc("/queue", b.requireAPIKey(b.handleQueueList))
+	mux.HandleFunc("/queue/{id}", b.requireAPIKey(b.handleQueueDrop))
+}
+
+// requireAPIKey rejects requests that don't carry the configured key in
+// the X-API-Key header.
+func (b *Backend) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(b.config.APIKey)) != 1 {
+			b.logger.Warn("Rejected API request with invalid key", "client_ip", b.clientIP(r))
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (b *Backend) handleAPISend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	logger := b.logger.WithGroup("api").With("client_ip", b.clientIP(r))
+
+	if b.maintenance.Load() {
+		writeJSONError(w, http.StatusServiceUnavailable, "service in maintenance, try again later")
+		return
+	}
+
+	// Base64 attachments inflate the payload, so allow some headroom. The
+	// body is read up to exactly what is reserved.
+	reserved := reservationSize(r.ContentLength, 2*b.config.MaxMessageBytes)
+	if !b.budget.tryAcquire(reserved) {
+		logger.Warn("In-flight memory budget exhausted, rejecting request", "reserve_bytes", reserved)
+		writeJSONError(w, http.StatusServiceUnavailable, "insufficient resources, try again later")
+		return
+	}
+	defer b.budget.release(reserved)
+
+	r.Body = http.MaxBytesReader(w, r.Body, reserved)
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	msg, err := b.validateSendRequest(&req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger.Info("Processing API email", "from", req.From, "to", msg.To, "cc", msg.Cc, "subject", msg.Subject)
+	b.redirectRecipients(msg, logger)
+
+	mailbox := b.resolveMailbox(req.From, logger)
+	if err := b.sendViaGraph(mailbox, msg); err != nil {
+		if isTokenError(err) {
+			logger.Error("Failed to acquire Graph token", "error", err)
+			metrics.Inc("token_errors_total", "Total failures acquiring an Azure AD token.")
+			writeJSONError(w, http.StatusServiceUnavailable, "temporary failure acquiring Graph token, try again later")
+			return
+		}
+		gerr := classifyGraphError(err)
+		logger.Error("Failed to send email via Graph", gerr.logAttrs()...)
+		writeJSONError(w, http.StatusBadGateway, gerr.Error())
+		return
+	}
+
+	logger.Info("Email sent successfully", "recipient_count", len(msg.To)+len(msg.Cc))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
+
+// handleMaintenance reports (GET) or sets (POST {"enabled": bool})
+// maintenance mode.
+func (b *Backend) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"enabled": true|false}`)
+			return
+		}
+		b.setMaintenance(*req.Enabled)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"maintenance": b.maintenance.Load()})
+}
+
+// handleQueueList returns the retry queue's messages (GET /queue).
+func (b *Backend) handleQueueList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if b.queue == nil {
+		writeJSONError(w, http.StatusNotFound, "retry queue is not enabled")
+		return
+	}
+	entries := b.queue.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"count": len(entries), "messages": entries})
+}
+
+// handleQueueDrop deletes a stuck message from the queue (DELETE /queue/{id}).
+func (b *Backend) handleQueueDrop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if b.queue == nil {
+		writeJSONError(w, http.StatusNotFound, "retry queue is not enabled")
+		return
+	}
+	id := r.PathValue("id")
+	if !b.queue.Drop(id) {
+		writeJSONError(w, http.StatusNotFound, "no queued message with id "+id)
+		return
+	}
+	b.logger.Warn("Queued message dropped via admin API", "id", id, "client_ip", b.clientIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "id": id})
+}
+
+// validateSendRequest checks the request against the same rules as the SMTP
+// path and converts it to an outgoingMessage.
+func (b *Backend) validateSendRequest(req *sendRequest) (*outgoingMessage, error) {
+	if len(req.To) == 0 {
+		if b.config.DefaultRecipient == "" {
+			return nil, fmt.Errorf("at least one recipient in \"to\" is required (no default_recipient configured)")
+		}
+		req.To = []string{b.config.DefaultRecipient}
+	}
+	for _, addr := range append(append([]string{}, req.To...), req.Cc...) {
+		if !strings.Contains(addr, "@") {
+			return nil, fmt.Errorf("invalid recipient address %q", addr)
+		}
+		if !recipientDomainAllowed(b.config, addr) {
+			return nil, fmt.Errorf("recipient domain not allowed: %s", addr)
+		}
+	}
+
+	contentType := strings.ToLower(req.ContentType)
+	switch contentType {
+	case "":
+		contentType = "text"
+	case "text", "html":
+	default:
+		return nil, fmt.Errorf("content_type must be \"text\" or \"html\"")
+	}
+
+	body := req.Body
+	if contentType == "html" && b.config.ForcePlainText {
+		body, contentType = htmlToText(body), "text"
+	}
+
+	subject := req.Subject
+	if subject == "" {
+		subject = b.config.DefaultSubject
+	}
+	subject = b.cleanSubject(subject, b.logger.WithGroup("api"))
+
+	seen := map[string]bool{}
+	msg := &outgoingMessage{
+		To:          dedupeAddresses(seen, req.To),
+		Cc:          dedupeAddresses(seen, req.Cc),
+		Subject:     subject,
+		Body:        body,
+		ContentType: contentType,
+		FromName:    b.config.FromDisplayName,
+	}
+
+	for i, a := range req.Attachments {
+		if a.Name == "" {
+			return nil, fmt.Errorf("attachment %d: name is required", i)
+		}
+		content, err := base64.StdEncoding.DecodeString(a.ContentBase64)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: invalid base64 content", a.Name)
+		}
+		if err := attachmentTypeAllowed(b.config, a.Name); err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", a.Name, err)
+		}
+		if attachmentTooLarge(b.config, int64(len(content))) {
+			return nil, fmt.Errorf("attachment %q exceeds %d bytes", a.Name, b.config.MaxAttachmentBytes)
+		}
+		attachType := a.ContentType
+		if attachType == "" {
+			attachType = "application/octet-stream"
+		}
+		msg.Attachments = append(msg.Attachments, outgoingAttachment{
+			Name:        a.Name,
+			ContentType: attachType,
+			Content:     content,
+		})
+	}
+
+	return msg, nil
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": "error", "error": message})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackend(config *Config) *Backend {
+	if config.EmailFrom == "" {
+		config.EmailFrom = "bridge@example.com"
+	}
+	if config.MaxMessageBytes == 0 {
+		config.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	return &Backend{
+		config: config,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestAPISend_RequiresKey(t *testing.T) {
+	b := newTestBackend(&Config{APIKey: "secret"})
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, b)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{}`))
+	req.Header.Set("X-API-Key", "wrong")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestValidateSendRequest(t *testing.T) {
+	b := newTestBackend(&Config{DefaultSubject: "(No Subject)"})
+
+	_, err := b.validateSendRequest(&sendRequest{})
+	assert.Error(t, err)
+
+	msg, err := b.validateSendRequest(&sendRequest{
+		To:          []string{"user@example.com"},
+		Cc:          []string{"cc@example.com"},
+		Body:        "<p>hi</p>",
+		ContentType: "HTML",
+		Attachments: []sendRequestAttach{{Name: "a.txt", ContentBase64: "aGVsbG8="}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "html", msg.ContentType)
+	assert.Equal(t, "(No Subject)", msg.Subject)
+	assert.Equal(t, []byte("hello"), msg.Attachments[0].Content)
+	assert.Equal(t, "application/octet-stream", msg.Attachments[0].ContentType)
+}
+
+func TestValidateSendRequest_DefaultRecipient(t *testing.T) {
+	b := newTestBackend(&Config{DefaultRecipient: "alerts@contoso.com"})
+	msg, err := b.validateSendRequest(&sendRequest{Subject: "disk full", Body: "sda1 at 98%"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alerts@contoso.com"}, msg.To)
+
+	// Configured recipients are still subject to the domain rules
+	b.config.AllowedRecipientDomains = []string{"example.com"}
+	_, err = b.validateSendRequest(&sendRequest{Body: "x"})
+	assert.ErrorContains(t, err, "not allowed")
+}
+
+func TestAPISend_DefaultRecipient(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{APIKey: "secret", GraphTimeout: time.Second})
+	b.sender = sender
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, b)
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{"subject": "disk full", "body": "sda1 at 98%"}`))
+		req.Header.Set("X-API-Key", "secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post())
+	assert.Empty(t, sender.messages)
+
+	b.config.DefaultRecipient = "alerts@contoso.com"
+	assert.Equal(t, http.StatusOK, post())
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "alerts@contoso.com", *sender.messages[0].GetToRecipients()[0].GetEmailAddress().GetAddress())
+}
+
+func TestClientIP_TrustedProxyHeader(t *testing.T) {
+	b := newTestBackend(&Config{TrustedProxyHeader: "X-Forwarded-For"})
+	var err error
+	b.trustedProxies, err = parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},                  // untrusted peer: header ignored
+		{"10.0.0.5:1234", "198.51.100.1", "198.51.100.1"},                    // trusted peer
+		{"10.0.0.5:1234", "1.2.3.4, 198.51.100.1, 10.0.0.7", "198.51.100.1"}, // spoofed prefix skipped
+		{"192.168.1.1:1234", "", "192.168.1.1"},                              // no header
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		assert.Equal(t, tt.want, b.clientIP(req), tt.xff)
+	}
+
+	_, err = parseCIDRs([]string{"not-a-cidr"})
+	assert.Error(t, err)
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	b := newTestBackend(&Config{APIKey: "secret"})
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, b)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader(`{"enabled": true}`))
+	req.Header.Set("X-API-Key", "secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, b.maintenance.Load())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{}`))
+	req.Header.Set("X-API-Key", "secret")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+type fakeCredential struct{ err error }
+
+func (c *fakeCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token"}, c.err
+}
+
+func TestHealthMux_ProbePaths(t *testing.T) {
+	cred := &fakeCredential{}
+	b := newTestBackend(&Config{HealthPath: "/livez", ReadyPath: "/readyz"})
+	b.credential = cred
+	mux := newHealthMux(b)
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/livez"))
+	assert.Equal(t, http.StatusNotFound, get("/health"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+
+	cred.err = errors.New("certificate expired")
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+	assert.Equal(t, http.StatusOK, get("/livez"), "liveness doesn't depend on Graph")
+
+	cred.err = nil
+	b.setMaintenance(true)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	assert.NoError(t, validateProbePaths("/health", ""))
+	assert.Error(t, validateProbePaths("healthz", ""))
+	assert.Error(t, validateProbePaths("/health", "/metrics"))
+	assert.Error(t, validateProbePaths("/health", "/health"))
+}
+
+func TestHealthMux_DeepCheckHidesTokenError(t *testing.T) {
+	var logs lockedBuffer
+	b := newTestBackend(&Config{HealthPath: "/health"})
+	b.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	b.credential = &fakeCredential{err: errors.New("AADSTS700027: certificate for app 11111111-2222 in tenant contoso expired")}
+
+	rec := httptest.NewRecorder()
+	newHealthMux(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health?deep=true", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "error": "token acquisition failed"}`, rec.Body.String())
+	assert.Contains(t, logs.String(), "AADSTS700027", "details are logged for the operator")
+}
+
+func TestAdminQueue(t *testing.T) {
+	config := &Config{APIKey: "secret", QueueMaxRetries: 3}
+	b := newTestBackend(config)
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, b)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", "secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queue").Code, "queue disabled")
+
+	var err error
+	b.queue, err = newRetryQueue(config, b)
+	require.NoError(t, err)
+	id, err := b.queue.Enqueue("bridge@example.com", &outgoingMessage{To: []string{"user@example.com"}, Subject: "stuck"}, 2, "throttled", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+
+	rec := do(http.MethodGet, "/queue")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Count    int          `json:"count"`
+		Messages []queueEntry `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Equal(t, 1, list.Count)
+	assert.Equal(t, id, list.Messages[0].ID)
+	assert.Equal(t, []string{"user@example.com"}, list.Messages[0].To)
+	assert.Equal(t, 2, list.Messages[0].Attempts)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/queue/"+id).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/queue/"+id).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/queue/"+id).Code)
+	assert.Empty(t, b.queue.List())
+
+	req := httptest.NewRequest(http.MethodGet, "/queue", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveRaw keeps the exact bytes received in DATA for compliance: written
+// to archive_dir as .eml and/or attached to a copy sent to archive_mailbox.
+// Data calls it once the message has passed every check, with the bytes
+// as received, untouched by parsing or rewriting. Failures are logged and
+// counted but never fail the message.
+func (b *Backend) archiveRaw(raw []byte, envelopeFrom string, envelopeTo []string, logger *slog.Logger) {
+	dir, mailbox := b.config.ArchiveDir, b.config.ArchiveMailbox
+	if dir == "" && mailbox == "" {
+		return
+	}
+	name := time.Now().UTC().Format("20060102T150405Z") + "-" + newQueueID() + ".eml"
+
+	if dir != "" {
+		if err := writeArchiveFile(dir, name, raw); err != nil {
+			logger.Error("Failed to archive raw message", "error", err)
+			metrics.Inc("archive_errors_total", "Total raw messages that could not be archived.")
+		} else {
+			logger.Debug("Archived raw message", "file", name)
+		}
+	}
+
+	if mailbox != "" {
+		msg := &outgoingMessage{
+			To:          []string{mailbox},
+			Subject:     "Archived message " + name,
+			Body:        fmt.Sprintf("Original message received by smtp-graph-bridge.\nEnvelope from: %s\nEnvelope to: %v\n", envelopeFrom, envelopeTo),
+			ContentType: "text",
+			Attachments: []outgoingAttachment{{Name: name, ContentType: "message/rfc822", Content: raw}},
+			Date:        time.Now(),
+		}
+		// Sent in the background so archiving doesn't add a Graph round trip
+		// to every SMTP transaction; shutdown waits for it
+		b.background.Add(1)
+		go func() {
+			defer b.background.Done()
+			if err := b.sendGraphMessage(b.config.EmailFrom, msg); err != nil {
+				logger.Error("Failed to send archive copy", "archive_mailbox", mailbox, "error", err)
+				metrics.Inc("archive_errors_total", "Total raw messages that could not be archived.")
+			}
+		}()
+	}
+}
+
+func writeArchiveFile(dir, name string, raw []byte) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmp, raw, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen fast-fails sends while the breaker is open.
+var errCircuitOpen = errors.New("graph circuit breaker open: sends paused after repeated throttling or service errors")
+
+// Breaker states, also exported as the graph_circuit_state gauge.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+var circuitStateNames = map[int]string{circuitClosed: "closed", circuitOpen: "open", circuitHalfOpen: "half-open"}
+
+// circuitBreaker stops calling Graph after circuit_breaker_threshold
+// consecutive 429/5xx/timeout failures. While open, sends fail fast (451)
+// for circuit_breaker_cooldown, or for as long as Graph's Retry-After asks
+// if that is longer. Then a single probe send is let through: success closes
+// the breaker, failure opens it again. A nil breaker lets everything through.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	logger    *slog.Logger
+
+	state     int
+	failures  int       // consecutive breaker failures while closed
+	openUntil time.Time // end of the current cooldown
+	probing   bool      // a half-open probe is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, logger *slog.Logger) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	metrics.Set("graph_circuit_state", "Graph circuit breaker state (0 closed, 1 open, 2 half-open).", circuitClosed)
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, logger: logger}
+}
+
+// allow reports whether a send may go to Graph now. In half-open state only
+// the first caller gets through, as the probe.
+func (cb *circuitBreaker) allow(now time.Time) error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitOpen && !now.Before(cb.openUntil) {
+		cb.setState(circuitHalfOpen)
+	}
+	switch {
+	case cb.state == circuitClosed:
+		return nil
+	case cb.state == circuitHalfOpen && !cb.probing:
+		cb.probing = true
+		return nil
+	}
+	metrics.Inc("graph_circuit_rejections_total", "Total sends failed fast by the open Graph circuit breaker.")
+	return errCircuitOpen
+}
+
+// record feeds the outcome of an allowed send back into the breaker. Only
+// throttling, 5xx and timeouts count as failures; any other answer shows
+// Graph is up.
+func (cb *circuitBreaker) record(err error, now time.Time) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	wasProbe := cb.probing
+	cb.probing = false
+
+	var retryAfter time.Duration
+	failed := false
+	if err != nil && !isTokenError(err) {
+		ge := classifyGraphError(err)
+		failed = isBreakerFailure(ge)
+		retryAfter = ge.RetryAfter
+	}
+	if !failed {
+		cb.failures = 0
+		if cb.state != circuitClosed {
+			cb.setState(circuitClosed)
+		}
+		return
+	}
+
+	cb.failures++
+	if wasProbe || cb.failures >= cb.threshold {
+		cooldown := max(cb.cooldown, retryAfter)
+		cb.openUntil = now.Add(cooldown)
+		cb.failures = 0
+		cb.setState(circuitOpen)
+		cb.logger.Warn("Graph circuit breaker opened, failing sends fast", "cooldown", cooldown, "retry_after", retryAfter, "error", err)
+	}
+}
+
+// setState switches state, logging and exporting the transition. Callers
+// hold cb.mu.
+func (cb *circuitBreaker) setState(state int) {
+	if state == cb.state {
+		return
+	}
+	if state != circuitOpen {
+		cb.logger.Info("Graph circuit breaker state changed", "from", circuitStateNames[cb.state], "to", circuitStateNames[state])
+	}
+	cb.state = state
+	metrics.Set("graph_circuit_state", "Graph circuit breaker state (0 closed, 1 open, 2 half-open).", float64(state))
+}
+
+// isBreakerFailure reports whether a Graph error suggests Graph is
+// overloaded or down rather than rejecting this particular message:
+// classifyGraphError answers 451 for exactly those (throttling, 5xx and
+// timeouts).
+func isBreakerFailure(ge *graphError) bool {
+	return ge.Reply.Code == 451
+}
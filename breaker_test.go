@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	assert.Nil(t, newCircuitBreaker(0, time.Minute, logger))
+
+	cb := newCircuitBreaker(2, 30*time.Second, logger)
+	now := time.Now()
+	unavailable := newODataError(503, "ServiceUnavailable")
+
+	// Non-throttling errors prove Graph is up and reset the count
+	require.NoError(t, cb.allow(now))
+	cb.record(unavailable, now)
+	cb.record(newODataError(400, "ErrorInvalidRecipients"), now)
+	cb.record(unavailable, now)
+	require.NoError(t, cb.allow(now), "still closed")
+
+	// A second consecutive failure opens it; Retry-After stretches the cooldown
+	throttled := newODataError(429, "ApplicationThrottled")
+	headers := abstractions.NewResponseHeaders()
+	headers.Add("Retry-After", "120")
+	throttled.SetResponseHeaders(headers)
+	cb.record(throttled, now)
+	assert.ErrorIs(t, cb.allow(now.Add(time.Minute)), errCircuitOpen)
+	assert.Equal(t, 451, classifyGraphError(errCircuitOpen).Reply.Code)
+	assert.Equal(t, float64(circuitOpen), metrics.Get("graph_circuit_state"))
+
+	// Half-open: one probe goes through, the rest still fail fast
+	later := now.Add(2 * time.Minute)
+	require.NoError(t, cb.allow(later))
+	assert.ErrorIs(t, cb.allow(later), errCircuitOpen)
+
+	// A failed probe reopens for the configured cooldown
+	cb.record(unavailable, later)
+	assert.ErrorIs(t, cb.allow(later.Add(10*time.Second)), errCircuitOpen)
+
+	// A successful probe closes it
+	later = later.Add(30 * time.Second)
+	require.NoError(t, cb.allow(later))
+	cb.record(nil, later)
+	assert.NoError(t, cb.allow(later))
+	assert.NoError(t, cb.allow(later))
+	assert.Equal(t, float64(circuitClosed), metrics.Get("graph_circuit_state"))
+
+	// Failures that don't come from Graph being overloaded don't count
+	cb.record(errors.New("unrelated"), later)
+	cb.record(errors.New("unrelated"), later)
+	assert.NoError(t, cb.allow(later))
+}
@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// memoryBudget caps the bytes held by in-flight messages across all sessions.
+// A nil budget is unlimited.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit}
+}
+
+// tryAcquire reserves n bytes, returning false if that would exceed the limit.
+func (b *memoryBudget) tryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	metrics.Set("inflight_bytes", "Bytes reserved by in-flight messages.", float64(b.used))
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	metrics.Set("inflight_bytes", "Bytes reserved by in-flight messages.", float64(b.used))
+}
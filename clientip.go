@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses trusted_proxy_cidrs. Bare IPs are treated as /32 or /128.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipTrusted(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the HTTP client. The configured proxy
+// header is only honoured when the direct peer is a trusted proxy; the
+// result is then the right-most header entry that isn't itself trusted,
+// so a client can't spoof its address by prepending entries.
+func (b *Backend) clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	header := b.config.TrustedProxyHeader
+	peerIP := net.ParseIP(peer)
+	if header == "" || peerIP == nil || !ipTrusted(peerIP, b.trustedProxies) {
+		return peer
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values(header) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !ipTrusted(ip, b.trustedProxies) {
+			break
+		}
+	}
+	return client
+}
@@ -2,20 +2,20 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadConfig_Defaults(t *testing.T) {
-	// Ensure clean state
-	os.Unsetenv("MS_GRAPH_TENANT_ID")
-	os.Unsetenv("MS_GRAPH_CLIENT_ID")
-	
-	// We expect error because required fields are missing, 
-	// but we want to check if defaults were applied internally before validation failed
-	// or we can mock a minimal config file.
-	
+	chdirTemp(t)
+	for _, key := range configKeys() {
+		t.Setenv(strings.ToUpper(key), "")
+	}
+
 	// Let's create a temporary config file
 	f, err := os.CreateTemp("", "config.*.yaml")
 	if err != nil {
@@ -32,30 +32,207 @@ ms_graph_email_from: "test@example.com"
 	f.WriteString(content)
 	f.Close()
 
-	// Point Viper to this file (we need to refactor loadConfig slightly to accept path 
-	// or we just test the parsing logic if we exposed it).
-	// Since loadConfig is hardcoded to look in specific paths, integration testing is harder without DI.
-	// However, we can test Env Var overrides which Viper supports automatically.
-	
-	os.Setenv("MS_GRAPH_TENANT_ID", "env-tenant")
-	os.Setenv("MS_GRAPH_CLIENT_ID", "env-client")
-	os.Setenv("MS_GRAPH_CERT_PATH", "env-path")
-	os.Setenv("MS_GRAPH_EMAIL_FROM", "env-from")
-	
-	config, err := loadConfig()
-	
-	// It might fail on ".env" or file loading if we are not careful, 
-	// but let's see if it picks up Env Vars which is the crucial part.
-	
-	if err == nil {
-		assert.Equal(t, "env-tenant", config.TenantID)
-		assert.Equal(t, "8025", config.SMTPPort) // Default
-		assert.Equal(t, "8080", config.HealthPort) // Default
+	config, err := loadConfig(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "test-tenant", config.TenantID)
+	assert.Equal(t, "8025", config.SMTPPort)   // Default
+	assert.Equal(t, "8080", config.HealthPort) // Default
+	assert.Equal(t, "/health", config.HealthPath)
+	assert.Equal(t, []string{"List-Unsubscribe", "List-Unsubscribe-Post"}, config.ForwardHeaders)
+
+	// Env vars still override the explicit file
+	t.Setenv("MS_GRAPH_TENANT_ID", "env-tenant")
+	config, err = loadConfig(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "env-tenant", config.TenantID)
+}
+
+func TestLoadConfig_MissingExplicitPath(t *testing.T) {
+	chdirTemp(t)
+	_, err := loadConfig("does-not-exist.yaml")
+	assert.Error(t, err)
+}
+
+// chdirTemp runs the test from an empty temp dir so only the files the test
+// writes are picked up as config.yaml / .env.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// setRequiredEnv clears the config env vars used in these tests and sets the
+// required ones so validation passes.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range configKeys() {
+		t.Setenv(strings.ToUpper(key), "")
 	}
+	t.Setenv("MS_GRAPH_TENANT_ID", "env-tenant")
+	t.Setenv("MS_GRAPH_CLIENT_ID", "env-client")
+	t.Setenv("MS_GRAPH_CERT_PATH", "env-path")
+	t.Setenv("MS_GRAPH_EMAIL_FROM", "env-from@example.com")
 }
 
-func TestParseEmail_Simple(t *testing.T) {
-	// Since we moved logic to go-message, we can test our usage of it if we extracted it.
-	// But logic is inside Session.Data which is hard to unit test without mocking dependencies.
-	// Skipped for now in favor of Integration tests in real usage.
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig_PrecedenceDefaults(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "8025", config.SMTPPort)
+	assert.Equal(t, "info", config.LogLevel)
+}
+
+func TestLoadConfig_PrecedenceDotEnvOverDefaults(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	writeFile(t, ".env", "SMTP_PORT=2525\nLOG_LEVEL=debug\n")
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "2525", config.SMTPPort)
+	assert.Equal(t, "debug", config.LogLevel)
+}
+
+func TestLoadConfig_PrecedenceYAMLOverDotEnv(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	writeFile(t, ".env", "SMTP_PORT=2525\nLOG_LEVEL=debug\n")
+	writeFile(t, "config.yaml", "smtp_port: 2626\n")
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "2626", config.SMTPPort)
+	assert.Equal(t, "debug", config.LogLevel) // not in YAML, .env still applies
+}
+
+func TestLoadConfig_PrecedenceEnvOverYAML(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	writeFile(t, ".env", "SMTP_PORT=2525\n")
+	writeFile(t, "config.yaml", "smtp_port: 2626\nms_graph_tenant_id: yaml-tenant\n")
+	t.Setenv("SMTP_PORT", "2727")
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "2727", config.SMTPPort)
+	assert.Equal(t, "env-tenant", config.TenantID)
+}
+
+func TestLoadConfig_AzureCloud(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "https://graph.microsoft.com", config.GraphBaseURL)
+	assert.Equal(t, "https://graph.microsoft.com/.default", graphScope(config))
+
+	t.Setenv("AZURE_CLOUD", "usgov")
+	config, err = loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "https://graph.microsoft.us", config.GraphBaseURL)
+	assert.Equal(t, "https://login.microsoftonline.us/", config.AuthorityHost)
+
+	t.Setenv("GRAPH_BASE_URL", "https://graph.example.test")
+	config, err = loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "https://graph.example.test", config.GraphBaseURL)
+
+	t.Setenv("AZURE_CLOUD", "germany")
+	_, err = loadConfig("")
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	writeFile(t, ".env", "LOG_LEVEL=debug\n")
+	writeFile(t, "config.json", `{"smtp_port": "2626", "allowed_recipient_domains": ["example.com"], "from_rewrite": {"@legacy.local": "@contoso.com"}}`)
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "2626", config.SMTPPort)
+	assert.Equal(t, []string{"example.com"}, config.AllowedRecipientDomains)
+	assert.Equal(t, "@contoso.com", config.FromRewrite["@legacy.local"])
+	assert.Equal(t, "debug", config.LogLevel) // .env still fills the gaps
+
+	// Env vars still win
+	t.Setenv("SMTP_PORT", "2727")
+	config, err = loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "2727", config.SMTPPort)
+
+	// Ambiguous: both formats in the same directory
+	writeFile(t, "config.yaml", "smtp_port: 2828\n")
+	_, err = loadConfig("")
+	assert.ErrorContains(t, err, "config.json")
+}
+
+func TestLoadConfig_Listeners(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	writeFile(t, "config.yaml", `
+allow_insecure_auth: true
+listeners:
+  - address: "127.0.0.1:2525"
+    tls: none
+  - address: ":587"
+    require_auth: true
+`)
+
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	listeners := smtpListeners(config)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, "none", listeners[0].TLS)
+	assert.False(t, *listeners[0].RequireAuth)
+	assert.Equal(t, "starttls", listeners[1].TLS)
+	assert.True(t, *listeners[1].RequireAuth)
+}
+
+func TestLoadConfig_GraphTimeout(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+
+	for _, timeout := range []string{"0s", "-5s"} {
+		t.Setenv("GRAPH_TIMEOUT", timeout)
+		_, err := loadConfig("")
+		assert.ErrorContains(t, err, "GRAPH_TIMEOUT must be positive", timeout)
+	}
+
+	t.Setenv("GRAPH_TIMEOUT", "10s")
+	config, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, config.GraphTimeout)
+}
+
+func TestLoadConfig_MaxInflightBytes(t *testing.T) {
+	chdirTemp(t)
+	setRequiredEnv(t)
+	t.Setenv("MAX_MESSAGE_BYTES", "1048576")
+
+	t.Setenv("MAX_INFLIGHT_BYTES", "1024")
+	_, err := loadConfig("")
+	assert.ErrorContains(t, err, "MAX_INFLIGHT_BYTES")
+
+	t.Setenv("MAX_INFLIGHT_BYTES", "1048576")
+	_, err = loadConfig("")
+	assert.NoError(t, err)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// graphError is a failed Graph send broken down into the fields support
+// needs for triage, plus the SMTP reply we give the client.
+type graphError struct {
+	Status  int    // HTTP status from Graph, 0 if the request never got a response
+	Code    string // Graph error code, e.g. ErrorAccessDenied
+	Message string
+	Hint    string // operator-facing explanation for well-known codes
+	// Graph's Retry-After on throttled or unavailable responses, 0 if absent
+	RetryAfter time.Duration
+	Reply      *smtp.SMTPError
+	Err        error
+}
+
+func (e *graphError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("graph error %s (%d): %s", e.Code, e.Status, e.Message)
+	}
+	return e.Err.Error()
+}
+
+func (e *graphError) Unwrap() error {
+	return e.Err
+}
+
+// logAttrs returns structured log fields describing the failure.
+func (e *graphError) logAttrs() []any {
+	attrs := []any{"error", e.Err}
+	if e.Status != 0 {
+		attrs = append(attrs, "graph_status", e.Status)
+	}
+	if e.Code != "" {
+		attrs = append(attrs, "graph_code", e.Code, "graph_message", e.Message)
+	}
+	if e.Hint != "" {
+		attrs = append(attrs, "hint", e.Hint)
+	}
+	return attrs
+}
+
+// isAccessPolicyDenial reports whether Graph refused the mailbox because of an
+// Exchange ApplicationAccessPolicy. Graph has no dedicated code for this; it
+// returns ErrorAccessDenied with a message mentioning the policy, e.g.
+// "Access to OData is disabled: [RAOP] : Blocked by tenant configured AppOnly AccessPolicy settings."
+func isAccessPolicyDenial(ge *graphError) bool {
+	if ge.Code != "ErrorAccessDenied" && ge.Status != http.StatusForbidden {
+		return false
+	}
+	return strings.Contains(ge.Message, "AccessPolicy") || strings.Contains(ge.Message, "[RAOP]")
+}
+
+// isMailboxUnavailable reports whether a send failed because the sender
+// mailbox itself can't be used (missing, disabled or unlicensed), as opposed
+// to a problem with the message or the service.
+func isMailboxUnavailable(err error) bool {
+	ge := classifyGraphError(err)
+	switch ge.Code {
+	case "MailboxNotEnabledForRESTAPI", "ErrorInvalidUser", "ResourceNotFound", "ErrorAccountDisabled", "ErrorMailboxMoveInProgress":
+		return true
+	}
+	return false
+}
+
+// isBodyRejection reports whether Graph refused msg because of its body: a
+// 400 whose message points at the body or its HTML, or a size rejection when
+// the body makes up most of the payload. A message that is mostly
+// attachments stays too large as text, so resending it wouldn't help.
+// Recipient and attachment errors don't count.
+func isBodyRejection(err error, msg *outgoingMessage) bool {
+	ge := classifyGraphError(err)
+	switch {
+	case ge.Code == "ErrorMessageSizeExceeded" || ge.Code == "RequestBodyTooLarge" || ge.Status == http.StatusRequestEntityTooLarge:
+		return bodyDominates(msg)
+	case ge.Status == http.StatusBadRequest && ge.Code != "ErrorInvalidRecipients":
+		msg := strings.ToLower(ge.Message)
+		return (strings.Contains(msg, "body") || strings.Contains(msg, "html")) && !strings.Contains(msg, "attachment")
+	}
+	return false
+}
+
+// bodyDominates reports whether msg's body is larger than its attachments
+// together, which holds for every message without attachments.
+func bodyDominates(msg *outgoingMessage) bool {
+	var attached int
+	for _, a := range msg.Attachments {
+		attached += len(a.Content)
+	}
+	return len(msg.Body) > attached
+}
+
+// classifyGraphError extracts the OData error code from a Graph SDK error
+// and maps well-known codes to a hint and an SMTP reply.
+func classifyGraphError(err error) *graphError {
+	ge := &graphError{Err: err, Message: err.Error()}
+
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) {
+		ge.Status = odataErr.ResponseStatusCode
+		if headers := odataErr.GetResponseHeaders(); headers != nil {
+			for _, v := range headers.Get("Retry-After") {
+				if secs, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && secs > 0 {
+					ge.RetryAfter = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		if main := odataErr.GetErrorEscaped(); main != nil {
+			if code := main.GetCode(); code != nil {
+				ge.Code = *code
+			}
+			if msg := main.GetMessage(); msg != nil {
+				ge.Message = *msg
+			}
+		}
+	}
+
+	switch {
+	case errors.Is(err, errDailyLimit):
+		ge.Hint = "the sending mailbox used up daily_send_limit; counts reset at midnight UTC"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Daily send limit reached for this mailbox, try again later"}
+	case errors.Is(err, errPacingBacklog):
+		ge.Hint = "more sends are waiting for this mailbox than mailbox_send_rate lets through in time"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Send rate for this mailbox exceeded, try again later"}
+	case errors.Is(err, errCircuitOpen):
+		ge.Hint = "Graph kept throttling or failing; sends resume after circuit_breaker_cooldown"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Graph sends paused after repeated failures, try again later"}
+	case ge.Code == "MailboxNotEnabledForRESTAPI":
+		ge.Hint = "sender mailbox is not licensed/enabled for Exchange Online REST"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 7}, Message: "Sender mailbox is not enabled for Graph (MailboxNotEnabledForRESTAPI)"}
+	case isAccessPolicyDenial(ge):
+		ge.Hint = "sender mailbox is outside the ApplicationAccessPolicy scope for this app; add it to the policy's security group (Test-ApplicationAccessPolicy)"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender mailbox is not permitted by the tenant's ApplicationAccessPolicy"}
+	case ge.Code == "ErrorSendAsDenied":
+		ge.Hint = "the sending mailbox lacks SendOnBehalf or SendAs rights on the From address (see send_on_behalf)"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sending mailbox may not send on behalf of the From address"}
+	case ge.Code == "ErrorAccessDenied" || ge.Code == "Authorization_RequestDenied" || ge.Status == http.StatusForbidden:
+		ge.Hint = "app lacks Mail.Send permission or admin consent for this mailbox"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Graph denied access to the sender mailbox"}
+	case ge.Code == "ErrorInvalidUser" || ge.Code == "ResourceNotFound" || ge.Status == http.StatusNotFound:
+		ge.Hint = "sender mailbox does not exist in the tenant"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 7}, Message: "Sender mailbox not found"}
+	case ge.Code == "ErrorInvalidRecipients":
+		ge.Hint = "Graph rejected one or more recipient addresses"
+		ge.Reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 3}, Message: "Invalid recipient address"}
+	case ge.Code == "ErrorMessageSizeExceeded" || ge.Status == http.StatusRequestEntityTooLarge:
+		ge.Hint = "message exceeds the mailbox send size limit"
+		ge.Reply = &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "Message too large for Graph"}
+	case ge.Status == http.StatusTooManyRequests || ge.Code == "ApplicationThrottled" || ge.Code == "TooManyRequests":
+		ge.Hint = "Graph is throttling this application or mailbox"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Graph is throttling requests, try again later"}
+	case ge.Status >= 500:
+		ge.Hint = "Graph service error"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Temporary Graph service error, try again later"}
+	case errors.Is(err, context.DeadlineExceeded):
+		ge.Hint = "Graph did not respond within graph_timeout"
+		ge.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Graph request timed out, try again later"}
+	case ge.Code != "":
+		ge.Reply = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 0, 0}, Message: "Graph rejected the message: " + ge.Code}
+	default:
+		ge.Reply = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 0, 0}, Message: "Error: transaction failed: " + err.Error()}
+	}
+
+	return ge
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newODataError(status int, code string) *odataerrors.ODataError {
+	main := odataerrors.NewMainError()
+	main.SetCode(&code)
+	msg := "details from Graph"
+	main.SetMessage(&msg)
+
+	err := odataerrors.NewODataError()
+	err.SetErrorEscaped(main)
+	err.ResponseStatusCode = status
+	return err
+}
+
+func TestClassifyGraphError(t *testing.T) {
+	tests := []struct {
+		err      error
+		smtpCode int
+	}{
+		{newODataError(400, "MailboxNotEnabledForRESTAPI"), 550},
+		{newODataError(403, "ErrorAccessDenied"), 550},
+		{newODataError(429, "ApplicationThrottled"), 451},
+		{newODataError(503, "ServiceUnavailable"), 451},
+		{errors.New("connection reset"), 554},
+	}
+	for _, tt := range tests {
+		ge := classifyGraphError(tt.err)
+		assert.Equal(t, tt.smtpCode, ge.Reply.Code, ge.Error())
+	}
+
+	policyErr := newODataError(403, "ErrorAccessDenied")
+	policyMsg := "Access to OData is disabled: [RAOP] : Blocked by tenant configured AppOnly AccessPolicy settings."
+	policyErr.GetErrorEscaped().SetMessage(&policyMsg)
+	ge := classifyGraphError(policyErr)
+	assert.Equal(t, 550, ge.Reply.Code)
+	assert.Contains(t, ge.Reply.Message, "ApplicationAccessPolicy")
+	assert.Contains(t, ge.Hint, "ApplicationAccessPolicy")
+
+	ge = classifyGraphError(newODataError(400, "MailboxNotEnabledForRESTAPI"))
+	assert.Equal(t, "MailboxNotEnabledForRESTAPI", ge.Code)
+	assert.Equal(t, "details from Graph", ge.Message)
+	assert.Contains(t, ge.logAttrs(), "graph_code")
+}
+
+func TestIsMailboxUnavailable(t *testing.T) {
+	assert.True(t, isMailboxUnavailable(newODataError(400, "MailboxNotEnabledForRESTAPI")))
+	assert.True(t, isMailboxUnavailable(newODataError(404, "ErrorInvalidUser")))
+	assert.False(t, isMailboxUnavailable(newODataError(429, "ApplicationThrottled")))
+	assert.False(t, isMailboxUnavailable(newODataError(400, "ErrorInvalidRecipients")))
+	assert.False(t, isMailboxUnavailable(errors.New("connection reset")))
+}
+
+func TestIsBodyRejection(t *testing.T) {
+	withMessage := func(status int, code, msg string) error {
+		err := newODataError(status, code)
+		err.GetErrorEscaped().SetMessage(&msg)
+		return err
+	}
+
+	html := &outgoingMessage{Body: "<p>" + strings.Repeat("x", 1000) + "</p>", ContentType: "html"}
+	assert.True(t, isBodyRejection(newODataError(413, "RequestBodyTooLarge"), html))
+	assert.True(t, isBodyRejection(newODataError(400, "ErrorMessageSizeExceeded"), html))
+	assert.True(t, isBodyRejection(withMessage(400, "ErrorInvalidRequest", "The message body could not be processed."), html))
+	assert.False(t, isBodyRejection(withMessage(400, "ErrorInvalidRequest", "Attachment body is invalid."), html))
+	assert.False(t, isBodyRejection(newODataError(400, "ErrorInvalidRecipients"), html))
+	assert.False(t, isBodyRejection(newODataError(503, "ServiceUnavailable"), html))
+
+	// Too large because of its attachments: the body isn't to blame
+	attached := *html
+	attached.Attachments = []outgoingAttachment{{Name: "big.eml", Content: make([]byte, 5000)}}
+	assert.False(t, isBodyRejection(newODataError(413, "RequestBodyTooLarge"), &attached))
+	attached.Attachments[0].Content = make([]byte, 10)
+	assert.True(t, isBodyRejection(newODataError(413, "RequestBodyTooLarge"), &attached))
+}
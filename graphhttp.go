@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	khttp "github.com/microsoft/kiota-http-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
+)
+
+// graphDebugBodyLimit caps how much of each request and response body is
+// logged; base64 attachments would otherwise flood the log.
+const graphDebugBodyLimit = 64 << 10
+
+// newGraphTransport returns the transport for Graph and Azure AD token
+// requests. Without graph_proxy, the HTTPS_PROXY and NO_PROXY environment
+// variables apply as usual. graph_ca_file adds CAs to the system pool, for
+// proxies that re-sign TLS traffic.
+func newGraphTransport(config *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true // as the SDK's default transport
+	if config.GraphProxy != "" {
+		proxyURL, err := url.Parse(config.GraphProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GRAPH_PROXY: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.GraphCAFile != "" {
+		pem, err := os.ReadFile(config.GraphCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GRAPH_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("GRAPH_CA_FILE %s contains no PEM certificates", config.GraphCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return transport, nil
+}
+
+// newGraphHTTPClient builds the HTTP client for the Graph request adapter:
+// the SDK's default middleware (retries, redirects, telemetry) over
+// transport, plus the debug transport when log_graph_http is set and
+// log_level is debug.
+func newGraphHTTPClient(config *Config, transport http.RoundTripper, logger *slog.Logger) *http.Client {
+	options := msgraphsdk.GetDefaultClientOptions()
+	client := msgraphcore.GetDefaultClient(&options)
+	if config.LogGraphHTTP && !logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Warn("log_graph_http has no effect unless log_level is debug")
+	} else if config.LogGraphHTTP {
+		// Below the middleware, so every retry is logged as its own request
+		transport = &graphDebugTransport{
+			next:   transport,
+			logger: logger.With("component", "graph_http"),
+			redact: config.LogRedact,
+		}
+	}
+	client.Transport = khttp.NewCustomTransportWithParentTransport(transport, msgraphcore.GetDefaultMiddlewaresWithOptions(&options)...)
+	return client
+}
+
+// graphDebugTransport logs each Graph request and response at debug level.
+// The Authorization header is never logged. Under log_redact, bodies are
+// left out, since they carry addresses and message content, and mailbox
+// addresses in the URL are masked like other logged addresses.
+type graphDebugTransport struct {
+	next   http.RoundTripper
+	logger *slog.Logger
+	redact bool
+}
+
+func (t *graphDebugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := t.logURL(req.URL)
+	attrs := []any{"method", req.Method, "url", target, "headers", redactedHeaders(req.Header)}
+	if !t.redact && req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		attrs = append(attrs, "body", truncateBody(body))
+	}
+	t.logger.Debug("Graph request", attrs...)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.logger.Debug("Graph request failed", "method", req.Method, "url", target, "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+
+	attrs = []any{"method", req.Method, "url", target, "status", resp.StatusCode,
+		"duration", time.Since(start), "headers", redactedHeaders(resp.Header)}
+	if !t.redact && resp.Body != nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		attrs = append(attrs, "body", truncateBody(body))
+	}
+	t.logger.Debug("Graph response", attrs...)
+	return resp, nil
+}
+
+// logURL renders u for the log. Under log_redact, path segments holding an
+// address (/users/<mailbox>/sendMail) go through redactAddress, and a query
+// with an address in it, such as a $filter, is dropped.
+func (t *graphDebugTransport) logURL(u *url.URL) string {
+	if !t.redact {
+		return u.String()
+	}
+	masked := *u
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		if strings.Contains(seg, "@") {
+			segments[i] = redactAddress(seg)
+		}
+	}
+	masked.Path = strings.Join(segments, "/")
+	masked.RawPath = ""
+	if query, err := url.QueryUnescape(u.RawQuery); err != nil || strings.Contains(query, "@") {
+		masked.RawQuery = "[redacted]"
+	}
+	return masked.String()
+}
+
+// redactedHeaders flattens h for logging, with credentials masked.
+func redactedHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for name, values := range h {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+			out[name] = "[redacted]"
+		default:
+			out[name] = strings.Join(values, ", ")
+		}
+	}
+	return out
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > graphDebugBodyLimit {
+		return string(body[:graphDebugBodyLimit]) + "... (truncated)"
+	}
+	return string(body)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphDebugTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"message":{}}`, string(body))
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"code":"ErrorInvalidRecipients"}}`)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	transport := &graphDebugTransport{
+		next:   http.DefaultTransport,
+		logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1.0/users/a/sendMail", strings.NewReader(`{"message":{}}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "ErrorInvalidRecipients", "response body still readable by the SDK")
+
+	out := logs.String()
+	assert.NotContains(t, out, "secret-token")
+	assert.Contains(t, out, "[redacted]")
+	assert.Contains(t, out, `{\"message\":{}}`)
+	assert.Contains(t, out, "status=400")
+	assert.Contains(t, out, "ErrorInvalidRecipients")
+}
+
+func TestGraphDebugTransport_Redact(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	transport := &graphDebugTransport{
+		next:   http.DefaultTransport,
+		logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		redact: true,
+	}
+	for _, target := range []string{
+		"/v1.0/users/alerts@contoso.com/sendMail",
+		"/v1.0/users/alerts%40contoso.com/sendMail",
+		"/v1.0/users?$filter=mail%20eq%20%27alerts@contoso.com%27",
+	} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+target, strings.NewReader(`{"message":{"subject":"payroll"}}`))
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	out := logs.String()
+	assert.NotContains(t, out, "alerts")
+	assert.NotContains(t, out, "payroll")
+	assert.Contains(t, out, "/v1.0/users/"+redactAddress("alerts@contoso.com")+"/sendMail")
+}
+
+func TestNewGraphTransport_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	transport, err := newGraphTransport(&Config{GraphProxy: proxy.URL})
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get("http://graph.example.invalid/v1.0/users")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "http://graph.example.invalid/v1.0/users", proxied)
+}
+
+func TestNewGraphTransport_CAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// Not trusted by default
+	transport, err := newGraphTransport(&Config{})
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(srv.URL)
+	require.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600))
+	transport, err = newGraphTransport(&Config{GraphCAFile: caFile})
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+	_, err = newGraphTransport(&Config{GraphCAFile: caFile})
+	assert.ErrorContains(t, err, "no PEM certificates")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// Importing charset also registers it with go-message, so body parts
+	// and address display names in charsets beyond UTF-8 and Latin-1
+	// decode too
+	"github.com/emersion/go-message/charset"
+)
+
+// encodedWord matches an RFC 2047 encoded-word: =?charset?B|Q?text?=
+var encodedWord = regexp.MustCompile(`=\?([^?\s]+)\?([bBqQ])\?([^?\s]*)\?=`)
+
+// decodeHeaderText decodes RFC 2047 encoded-words in an unstructured header
+// such as Subject to UTF-8. Unlike mime.WordDecoder it joins the bytes of
+// adjacent encoded-words in the same charset before converting them, so a
+// multi-byte character split across two words (common with long B-encoded
+// subjects) comes out whole. Whitespace between adjacent encoded-words is
+// dropped as RFC 2047 requires. Words in unknown charsets, or that fail to
+// decode, are left as they are.
+func decodeHeaderText(s string) string {
+	var out strings.Builder
+	var run []byte // decoded bytes of the current run of words
+	var runCharset string
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		out.WriteString(convertCharset(runCharset, run))
+		run, runCharset = nil, ""
+	}
+
+	last := 0
+	for _, m := range encodedWord.FindAllStringSubmatchIndex(s, -1) {
+		between := s[last:m[0]]
+		name := strings.ToLower(s[m[2]:m[3]])
+		// RFC 2231 language suffix: =?utf-8*en?...
+		if i := strings.IndexByte(name, '*'); i >= 0 {
+			name = name[:i]
+		}
+		decoded, ok := decodeWordText(s[m[4]:m[5]], s[m[6]:m[7]])
+		if ok && !charsetSupported(name) {
+			ok = false
+		}
+		if !ok {
+			flush()
+			out.WriteString(between)
+			out.WriteString(s[m[0]:m[1]])
+			last = m[1]
+			continue
+		}
+
+		adjacent := run != nil && strings.TrimSpace(between) == ""
+		if !adjacent || name != runCharset {
+			flush()
+			if !adjacent {
+				out.WriteString(between)
+			}
+		}
+		runCharset = name
+		run = append(run, decoded...)
+		last = m[1]
+	}
+	flush()
+	out.WriteString(s[last:])
+	return strings.ToValidUTF8(out.String(), "�")
+}
+
+// decodeWordText undoes the B or Q encoding of one encoded-word.
+func decodeWordText(encoding, text string) ([]byte, bool) {
+	if strings.EqualFold(encoding, "B") {
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			// Some senders drop the padding
+			b, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+		}
+		return b, err == nil
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '_':
+			b.WriteByte(' ')
+		case c == '=' && i+2 < len(text):
+			v, err := strconv.ParseUint(text[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, false
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		case c == '=':
+			return nil, false
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.Bytes(), true
+}
+
+func charsetSupported(name string) bool {
+	if name == "utf-8" || name == "us-ascii" {
+		return true
+	}
+	_, err := charset.Reader(name, bytes.NewReader(nil))
+	return err == nil
+}
+
+// convertCharset converts text from the named charset to UTF-8.
+func convertCharset(name string, text []byte) string {
+	if name == "utf-8" || name == "us-ascii" {
+		return string(text)
+	}
+	r, err := charset.Reader(name, bytes.NewReader(text))
+	if err != nil {
+		return string(text)
+	}
+	converted, err := io.ReadAll(r)
+	if err != nil {
+		return string(text)
+	}
+	return string(converted)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeHeaderText(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	euro := "\xe2\x82\xac" // € in UTF-8, split across two words below
+
+	tests := []struct {
+		in, want string
+	}{
+		{"Plain subject", "Plain subject"},
+		{"=?UTF-8?B?" + b64("Größe 100 € – Übersicht") + "?=", "Größe 100 € – Übersicht"},
+		{"=?UTF-8?B?" + b64("Preis: 5 "+euro[:1]) + "?= =?UTF-8?B?" + b64(euro[1:]) + "?=", "Preis: 5 €"},
+		{"=?utf-8?q?caf=C3=A9_au_lait?=", "café au lait"},
+		{"=?ISO-8859-2?Q?=A3=F3d=BC?= und =?windows-1252?Q?=80uro?=", "Łódź und €uro"},
+		{"=?KOI8-R?B?" + base64.StdEncoding.EncodeToString([]byte{0xf0, 0xd2, 0xc9, 0xd7, 0xc5, 0xd4}) + "?=", "Привет"},
+		{"=?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?=", "こんにちは"},
+		{"Re: =?utf-8?B?" + b64("Über") + "?= report", "Re: Über report"},
+		{"=?x-unknown?Q?abc?=", "=?x-unknown?Q?abc?="},
+		{"=?UTF-8?B?" + "w5xiZXI" + "?=", "Über"}, // missing padding
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, decodeHeaderText(tt.in), tt.in)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlToText renders an HTML body as plain text for force_plain_text: tags
+// are dropped, block elements become line breaks, list items get a "- "
+// prefix and links keep their target as "text (href)". Script and style
+// contents are discarded. It is meant for readable notification mail, not
+// faithful layout.
+func htmlToText(s string) string {
+	var out strings.Builder
+	var href string
+	skip := 0
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return tidyText(out.String())
+		case html.TextToken:
+			if skip == 0 {
+				// Source line breaks are just whitespace in HTML
+				out.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "script", "style", "head", "title":
+				if tok.Type == html.StartTagToken {
+					skip++
+				}
+			case "br":
+				out.WriteString("\n")
+			case "li":
+				out.WriteString("\n- ")
+			case "a":
+				href = ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" && !strings.HasPrefix(attr.Val, "#") {
+						href = attr.Val
+					}
+				}
+			default:
+				if blockElements[tok.Data] {
+					out.WriteString("\n")
+				}
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "script", "style", "head", "title":
+				if skip > 0 {
+					skip--
+				}
+			case "a":
+				if href != "" && skip == 0 {
+					out.WriteString(" (" + href + ")")
+				}
+				href = ""
+			default:
+				if blockElements[tok.Data] {
+					out.WriteString("\n")
+				}
+			}
+		}
+	}
+}
+
+var blockElements = map[string]bool{
+	"p": true, "div": true, "tr": true, "table": true, "ul": true, "ol": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true,
+}
+
+// tidyText collapses spaces within each line and runs of blank lines to one.
+func tidyText(s string) string {
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
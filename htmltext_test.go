@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	in := `<html><head><title>x</title><style>p { color: red }</style></head><body>
+<h1>Build   failed</h1>
+<p>Job <b>nightly</b> failed.<br>See <a href="https://ci.example.com/42">the log</a>.</p>
+<ul><li>step 1</li><li>step 2 &amp; 3</li></ul>
+<script>alert(1)</script>
+</body></html>`
+
+	assert.Equal(t, "Build failed\n\nJob nightly failed.\nSee the log (https://ci.example.com/42).\n\n- step 1\n- step 2 & 3", htmlToText(in))
+	assert.Equal(t, "plain", htmlToText("plain"))
+}
+
+func TestHTMLToText_Links(t *testing.T) {
+	in := `<p>Your invoice is ready: <a href="https://billing.example.com/inv/7">view invoice</a>.</p>` +
+		`<p><a href="#top">Back to top</a> or <a href="mailto:billing@example.com">contact us</a></p>`
+
+	assert.Equal(t, "Your invoice is ready: view invoice (https://billing.example.com/inv/7).\n\n"+
+		"Back to top or contact us (mailto:billing@example.com)", htmlToText(in))
+}
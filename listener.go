@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ListenerConfig is one entry of the listeners list: an SMTP address with
+// its own TLS and authentication settings, served by the shared Backend.
+type ListenerConfig struct {
+	Address     string `mapstructure:"address"`      // host:port
+	TLS         string `mapstructure:"tls"`          // "starttls" (default), "required", "implicit" or "none"
+	RequireAuth *bool  `mapstructure:"require_auth"` // unset = the global require_auth
+
+	RequireValidHELO *bool `mapstructure:"require_valid_helo"` // unset = the global require_valid_helo
+}
+
+// smtpListeners returns the configured listeners, or the single
+// smtp_host:smtp_port listener when none are, with defaults filled in.
+func smtpListeners(config *Config) []ListenerConfig {
+	if len(config.Listeners) == 0 {
+		return []ListenerConfig{{
+			Address:          net.JoinHostPort(config.SMTPHost, config.SMTPPort),
+			TLS:              "starttls",
+			RequireAuth:      &config.RequireAuth,
+			RequireValidHELO: &config.RequireValidHELO,
+		}}
+	}
+	listeners := make([]ListenerConfig, len(config.Listeners))
+	for i, l := range config.Listeners {
+		if l.TLS == "" {
+			l.TLS = "starttls"
+		}
+		if l.RequireAuth == nil {
+			l.RequireAuth = &config.RequireAuth
+		}
+		if l.RequireValidHELO == nil {
+			l.RequireValidHELO = &config.RequireValidHELO
+		}
+		listeners[i] = l
+	}
+	return listeners
+}
+
+// validateListeners checks every listener's address and TLS mode, and that
+// listeners requiring AUTH can offer it.
+func validateListeners(config *Config) error {
+	seen := make(map[string]bool)
+	for _, l := range smtpListeners(config) {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("LISTENERS: invalid address %q: %w", l.Address, err)
+		}
+		if seen[l.Address] {
+			return fmt.Errorf("LISTENERS: address %s is listed twice", l.Address)
+		}
+		seen[l.Address] = true
+
+		switch l.TLS {
+		case "none", "starttls":
+		case "required", "implicit":
+			if config.TLSCertFile == "" {
+				return fmt.Errorf("LISTENERS: %s uses tls %q, which needs TLS_CERT_FILE/TLS_KEY_FILE", l.Address, l.TLS)
+			}
+		default:
+			return fmt.Errorf("LISTENERS: %s has unknown tls %q (expected starttls, required, implicit or none)", l.Address, l.TLS)
+		}
+
+		// Without TLS, cleartext mechanisms would never be offered and
+		// nobody could authenticate
+		hasTLS := l.TLS != "none" && config.TLSCertFile != ""
+		if *l.RequireAuth && !config.AllowInsecureAuth && !hasTLS {
+			if len(config.Listeners) == 0 {
+				return fmt.Errorf("REQUIRE_AUTH needs TLS_CERT_FILE/TLS_KEY_FILE, or ALLOW_INSECURE_AUTH=true to allow AUTH PLAIN/LOGIN over an unencrypted connection")
+			}
+			return fmt.Errorf("LISTENERS: %s requires auth without TLS; configure TLS_CERT_FILE/TLS_KEY_FILE, or ALLOW_INSECURE_AUTH=true to allow AUTH PLAIN/LOGIN over an unencrypted connection", l.Address)
+		}
+	}
+	return nil
+}
+
+// listenerPolicy holds the session rules that can differ per listener.
+type listenerPolicy struct {
+	requireAuth      bool
+	requireTLS       bool // STARTTLS before MAIL FROM
+	requireValidHELO bool
+}
+
+// listenerBackend gives sessions the policy of the listener that accepted
+// them; everything else is the shared Backend.
+type listenerBackend struct {
+	*Backend
+	policy listenerPolicy
+}
+
+func (lb *listenerBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return lb.Backend.newSession(c, lb.policy)
+}
+
+// newListenerServer returns the SMTP server for one listener.
+func newListenerServer(b *Backend, l ListenerConfig) *smtp.Server {
+	server := newSMTPServer(b)
+	server.Addr = l.Address
+	server.Backend = &listenerBackend{Backend: b, policy: listenerPolicy{
+		requireAuth:      *l.RequireAuth,
+		requireTLS:       l.TLS == "required",
+		requireValidHELO: *l.RequireValidHELO,
+	}}
+	if l.TLS == "none" {
+		server.TLSConfig = nil
+	}
+	return server
+}
+
+// listenSMTP opens the socket for l with the connection limit, PROXY
+// protocol and greeting delay wrappers, and TLS outermost for implicit TLS
+// so go-smtp sees a *tls.Conn.
+func listenSMTP(b *Backend, l ListenerConfig, logger *slog.Logger) (net.Listener, error) {
+	ln, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	config := b.config
+	if config.MaxConnections > 0 {
+		ln = &limitListener{Listener: ln, max: config.MaxConnections}
+	}
+	if config.ProxyProtocol {
+		ln = &proxyListener{Listener: ln}
+	}
+	if config.GreetingDelay > 0 {
+		ln = &greetingDelayListener{Listener: ln, delay: config.GreetingDelay}
+	}
+	ln = &countingListener{Listener: ln}
+	if l.TLS == "implicit" {
+		ln = tls.NewListener(ln, b.tlsConfig)
+	}
+	logger.Info("SMTP server listening", "address", l.Address, "tls", l.TLS, "require_auth", *l.RequireAuth, "require_valid_helo", *l.RequireValidHELO)
+	return ln, nil
+}
+
+// countingListener records every connection accepted by the SMTP listener.
+type countingListener struct {
+	net.Listener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		metrics.Inc("connections_total", "Total SMTP connections accepted.")
+	}
+	return conn, err
+}
+
+// limitListener caps the number of open connections. Connections over the
+// limit get a 421 and are closed straight away, before any SMTP session
+// (or PROXY header read) is started.
+type limitListener struct {
+	net.Listener
+	max int
+
+	mu     sync.Mutex
+	active int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		l.mu.Lock()
+		if l.active >= l.max {
+			l.mu.Unlock()
+			metrics.Inc("connections_rejected_total", "Total SMTP connections rejected by max_connections.")
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(conn, "421 4.7.0 Too many connections, try again later\r\n")
+			conn.Close()
+			continue
+		}
+		l.active++
+		l.mu.Unlock()
+		return &limitConn{Conn: conn, listener: l}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	listener *limitListener
+	once     sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		c.listener.mu.Lock()
+		c.listener.active--
+		c.listener.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// greetingDelayListener holds back the SMTP greeting on every connection.
+// Spam bots tend to give up or talk early; well-behaved clients just wait.
+type greetingDelayListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l *greetingDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetingDelayConn{Conn: conn, delay: l.delay}, nil
+}
+
+type greetingDelayConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+// Write delays only the first write, which is the 220 greeting.
+func (c *greetingDelayConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Write(b)
+}
+
+// proxyHeaderTimeout bounds how long we wait for the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener expects every accepted connection to start with a PROXY
+// protocol (v1 or v2) header and exposes the client address it carries as
+// RemoteAddr. Only enable it behind a trusted load balancer.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The header is parsed lazily so a slow client can't stall Accept
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline last set by the SMTP server
+}
+
+// init reads the header under proxyHeaderTimeout, or the server's own
+// read deadline if that is sooner, then puts the server's deadline back.
+// The first read comes after go-smtp has set its idle_timeout deadline,
+// which clearing it would lose.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		headerDeadline := time.Now().Add(proxyHeaderTimeout)
+		if !deadline.IsZero() && deadline.Before(headerDeadline) {
+			headerDeadline = deadline
+		}
+		c.Conn.SetReadDeadline(headerDeadline)
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(deadline)
+	})
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY header. It returns a nil address for
+// headers that carry no client information (v1 UNKNOWN, v2 LOCAL).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case '\r':
+		return readProxyV2(r)
+	default:
+		return nil, errors.New("proxy protocol: missing PROXY header")
+	}
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol: malformed v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("proxy protocol: malformed v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("proxy protocol: malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("proxy protocol: invalid v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("proxy protocol: invalid v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("proxy protocol: unsupported v2 version")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	// LOCAL command: health checks from the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("proxy protocol: short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("proxy protocol: short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// isValidHELO reports whether a HELO/EHLO argument is a syntactically valid
+// fully qualified domain name or an RFC 5321 address literal ([192.0.2.1],
+// [IPv6:2001:db8::1]). Bare IP addresses and single-label names such as
+// "localhost" are not.
+func isValidHELO(name string) bool {
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		addr := name[1 : len(name)-1]
+		if v6, ok := strings.CutPrefix(addr, "IPv6:"); ok {
+			ip := net.ParseIP(v6)
+			return ip != nil && ip.To4() == nil
+		}
+		ip := net.ParseIP(addr)
+		return ip != nil && ip.To4() != nil && !strings.Contains(addr, ":")
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	// An all-numeric top-level label means a bare IP address
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
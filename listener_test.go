@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader_V1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 51234 25\r\nEHLO client\r\n"))
+
+	addr, err := readProxyHeader(r)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:51234", addr.String())
+
+	// The SMTP stream must be left intact after the header
+	rest, _ := r.ReadString('\n')
+	assert.Equal(t, "EHLO client\r\n", rest)
+}
+
+func TestReadProxyHeader_V2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x11}) // v2 PROXY, AF_INET/STREAM
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(net.ParseIP("198.51.100.9").To4())
+	buf.Write(net.ParseIP("10.0.0.1").To4())
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(25))
+
+	addr, err := readProxyHeader(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.9:40000", addr.String())
+}
+
+func TestReadProxyHeader_Missing(t *testing.T) {
+	_, err := readProxyHeader(bufio.NewReader(strings.NewReader("EHLO client\r\n")))
+	assert.Error(t, err)
+}
+
+func TestProxyListener_IdleTimeout(t *testing.T) {
+	b := newTestBackend(&Config{IdleTimeout: 100 * time.Millisecond})
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := newSMTPServer(b)
+	go server.Serve(&proxyListener{Listener: inner})
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	_, _, err = text.ReadResponse(220)
+	require.NoError(t, err)
+
+	// Only the PROXY header, then nothing: idle_timeout still applies
+	_, err = io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 25\r\n")
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	code, _, err := text.ReadResponse(0)
+	require.NoError(t, err)
+	assert.Equal(t, 421, code)
+	_, err = text.ReadLine()
+	assert.ErrorIs(t, err, io.EOF, "the connection is closed")
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := &limitListener{Listener: inner, max: 1}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	held := <-accepted
+
+	second, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	reply, _ := bufio.NewReader(second).ReadString('\n')
+	assert.True(t, strings.HasPrefix(reply, "421 "), reply)
+
+	// Closing the held connection frees the slot
+	held.Close()
+	third, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer third.Close()
+	(<-accepted).Close()
+}
+
+func TestListeners_PerListenerSettings(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	authTrue := true
+	config := &Config{
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+		TLSMinVersion: "1.2",
+		Listeners: []ListenerConfig{
+			{Address: "127.0.0.1:0", TLS: "none"},
+			{Address: "127.0.0.1:1", TLS: "required", RequireAuth: &authTrue},
+			{Address: "127.0.0.1:2", TLS: "implicit"},
+		},
+	}
+	require.NoError(t, validateListeners(config))
+	b := newTestBackend(config)
+	var err error
+	b.tlsConfig, err = buildTLSConfig(config)
+	require.NoError(t, err)
+
+	serve := func(l ListenerConfig) string {
+		l.Address = "127.0.0.1:0"
+		ln, err := listenSMTP(b, l, b.logger)
+		require.NoError(t, err)
+		server := newListenerServer(b, l)
+		go server.Serve(ln)
+		t.Cleanup(func() { server.Close() })
+		return ln.Addr().String()
+	}
+	listeners := smtpListeners(config)
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+
+	// Internal plaintext listener: no STARTTLS, no auth
+	c, err := smtp.Dial(serve(listeners[0]))
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example"))
+	ok, _ := c.Extension("STARTTLS")
+	assert.False(t, ok)
+	assert.NoError(t, c.Mail("sender@example.com", nil))
+	c.Close()
+
+	// External listener: MAIL is refused until STARTTLS, then until AUTH
+	addr := serve(listeners[1])
+	c, err = smtp.Dial(addr)
+	require.NoError(t, err)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Mail("sender@example.com", nil), &smtpErr)
+	assert.Equal(t, "Must issue a STARTTLS command first", smtpErr.Message)
+	c.Close()
+	c, err = smtp.DialStartTLS(addr, clientTLS)
+	require.NoError(t, err)
+	require.ErrorAs(t, c.Mail("sender@example.com", nil), &smtpErr)
+	assert.Equal(t, errAuthRequired.Message, smtpErr.Message)
+	c.Close()
+
+	// Implicit TLS listener
+	c, err = smtp.DialTLS(serve(listeners[2]), clientTLS)
+	require.NoError(t, err)
+	assert.NoError(t, c.Mail("sender@example.com", nil))
+	c.Close()
+}
+
+func TestValidateListeners(t *testing.T) {
+	assert.NoError(t, validateListeners(&Config{SMTPPort: "8025"}))
+	assert.ErrorContains(t, validateListeners(&Config{Listeners: []ListenerConfig{{Address: "0.0.0.0:465", TLS: "implicit"}}}), "needs TLS_CERT_FILE")
+	assert.ErrorContains(t, validateListeners(&Config{Listeners: []ListenerConfig{{Address: "0.0.0.0:25", TLS: "bogus"}}}), "unknown tls")
+	assert.ErrorContains(t, validateListeners(&Config{Listeners: []ListenerConfig{{Address: ":25"}, {Address: ":25"}}}), "listed twice")
+	assert.ErrorContains(t, validateListeners(&Config{SMTPPort: "8025", RequireAuth: true}), "REQUIRE_AUTH needs TLS_CERT_FILE")
+}
+
+func TestIsValidHELO(t *testing.T) {
+	for _, name := range []string{"mail.example.com", "mail.example.com.", "relay-01.corp.example", "[192.0.2.1]", "[IPv6:2001:db8::1]"} {
+		assert.True(t, isValidHELO(name), name)
+	}
+	for _, name := range []string{"localhost", "printer", "192.0.2.1", "[192.0.2.256]", "[2001:db8::1]", "-bad.example.com", "mail..example.com", "mail_01.example.com", "ex ample.com"} {
+		assert.False(t, isValidHELO(name), name)
+	}
+}
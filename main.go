@@ -1,96 +1,391 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	kiotaauth "github.com/microsoft/kiota-authentication-azure-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
-	"github.com/microsoftgraph/msgraph-sdk-go/users"
 	"github.com/spf13/viper"
 	"software.sslmate.com/src/go-pkcs12"
 )
 
+// azureClouds maps azure_cloud names to their Graph and Azure AD endpoints.
+var azureClouds = map[string]struct{ graph, authority string }{
+	"public":   {"https://graph.microsoft.com", "https://login.microsoftonline.com/"},
+	"usgov":    {"https://graph.microsoft.us", "https://login.microsoftonline.us/"},
+	"usgovdod": {"https://dod-graph.microsoft.us", "https://login.microsoftonline.us/"},
+	"china":    {"https://microsoftgraph.chinacloudapi.cn", "https://login.chinacloudapi.cn/"},
+}
+
+// graphScope returns the token scope for the configured Graph endpoint.
+func graphScope(config *Config) string {
+	return strings.TrimSuffix(config.GraphBaseURL, "/") + "/.default"
+}
+
+const defaultMaxMessageBytes = 10 * 1024 * 1024 // 10MB
+
 type Config struct {
-	TenantID       string `mapstructure:"ms_graph_tenant_id"`
-	ClientID       string `mapstructure:"ms_graph_client_id"`
-	CertPath       string `mapstructure:"ms_graph_cert_path"`
-	CertPassword   string `mapstructure:"ms_graph_cert_pass"`
-	EmailFrom      string `mapstructure:"ms_graph_email_from"`
-	SMTPPort       string `mapstructure:"smtp_port"`
-	SMTPHost       string `mapstructure:"smtp_host"`
-	RequireAuth    bool   `mapstructure:"require_auth"`
-	AuthUsername   string `mapstructure:"smtp_auth_username"`
-	AuthPassword   string `mapstructure:"smtp_auth_password"`
-	HealthPort     string `mapstructure:"health_port"`
-	LogLevel       string `mapstructure:"log_level"`
+	// Microsoft Graph / Azure AD
+	TenantID             string        `mapstructure:"ms_graph_tenant_id"`
+	ClientID             string        `mapstructure:"ms_graph_client_id"`
+	CertPath             string        `mapstructure:"ms_graph_cert_path"`
+	CertBase64           string        `mapstructure:"ms_graph_cert_base64"`
+	CertPEM              string        `mapstructure:"ms_graph_cert_pem"`
+	KeyPEM               string        `mapstructure:"ms_graph_key_pem"`
+	CertPassword         string        `mapstructure:"ms_graph_cert_pass"`
+	EmailFrom            string        `mapstructure:"ms_graph_email_from"`
+	FallbackEmailFrom    string        `mapstructure:"fallback_email_from"` // used when the sender mailbox is missing or not enabled
+	SendOnBehalf         bool          `mapstructure:"send_on_behalf"`      // From = header author, Sender = sending mailbox
+	AzureCloud           string        `mapstructure:"azure_cloud"`
+	GraphBaseURL         string        `mapstructure:"graph_base_url"` // defaults from AzureCloud
+	AuthorityHost        string        `mapstructure:"authority_host"` // defaults from AzureCloud
+	GraphTimeout         time.Duration `mapstructure:"graph_timeout"`
+	GraphProxy           string        `mapstructure:"graph_proxy"`   // proxy for Graph and token requests (empty = HTTPS_PROXY/NO_PROXY)
+	GraphCAFile          string        `mapstructure:"graph_ca_file"` // extra PEM CAs trusted for Graph, e.g. a TLS-inspecting proxy
+	CertExpiryWarnDays   int           `mapstructure:"cert_expiry_warn_days"`
+	CertExpiryFail       bool          `mapstructure:"cert_expiry_fail"`
+	TokenWarmup          bool          `mapstructure:"token_warmup"`
+	VerifyMailbox        string        `mapstructure:"verify_mailbox"`         // look up ms_graph_email_from at startup: "off", "warn" or "fail"
+	StartupTestRecipient string        `mapstructure:"startup_test_recipient"` // send a test message here at startup (empty = off)
+	StartupTestFail      bool          `mapstructure:"startup_test_fail"`      // exit if the startup test fails
+
+	// Graph circuit breaker: fail sends fast after this many consecutive
+	// 429/5xx/timeouts (0 = off), for at least the cooldown
+	CircuitBreakerThreshold int           `mapstructure:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown  time.Duration `mapstructure:"circuit_breaker_cooldown"`
+
+	// SMTP server
+	SMTPPort      string `mapstructure:"smtp_port"`
+	SMTPHost      string `mapstructure:"smtp_host"`
+	RequireAuth   bool   `mapstructure:"require_auth"`
+	AuthUsername  string `mapstructure:"smtp_auth_username"`
+	AuthPassword  string `mapstructure:"smtp_auth_password"`
+	ProxyProtocol bool   `mapstructure:"proxy_protocol"`
+
+	// Refuse HELO/EHLO names that aren't a FQDN or address literal (501).
+	// With the exemption, such clients may still send after AUTH.
+	RequireValidHELO        bool `mapstructure:"require_valid_helo"`
+	HELOExemptAuthenticated bool `mapstructure:"helo_exempt_authenticated"`
+
+	// SMTP listeners with their own TLS and auth settings, all served by
+	// one backend. When set, they replace the smtp_host/smtp_port listener.
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+
+	// Concurrent connection cap; extra connections get 421 (0 = unlimited)
+	MaxConnections int `mapstructure:"max_connections"`
+	// Concurrent sessions per client IP; extra sessions get 421 at HELO/EHLO
+	// (0 = unlimited)
+	MaxSessionsPerIP int `mapstructure:"max_sessions_per_ip"`
+
+	// Largest accepted message, advertised to clients via EHLO SIZE
+	MaxMessageBytes int64 `mapstructure:"max_message_bytes"`
+	// Largest decoded body part (0 = only max_message_bytes applies)
+	MaxPartBytes int64 `mapstructure:"max_part_bytes"`
+
+	// SASL mechanisms to advertise (PLAIN, LOGIN). Both send the password in
+	// the clear, so they are only offered over TLS unless AllowInsecureAuth.
+	AuthMechanisms    []string `mapstructure:"auth_mechanisms"`
+	AllowInsecureAuth bool     `mapstructure:"allow_insecure_auth"`
+
+	// STARTTLS (offered when a certificate is configured)
+	TLSCertFile     string   `mapstructure:"tls_cert_file"`
+	TLSKeyFile      string   `mapstructure:"tls_key_file"`
+	TLSMinVersion   string   `mapstructure:"tls_min_version"`
+	TLSCipherSuites []string `mapstructure:"tls_cipher_suites"`
+
+	// Sessions waiting this long for the next command get 421 and are closed
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+
+	// Tarpitting
+	GreetingDelay        time.Duration `mapstructure:"greeting_delay"`
+	MaxCommandsPerMinute int           `mapstructure:"max_commands_per_minute"`
+
+	// Global cap on bytes buffered by in-flight messages (0 = unlimited)
+	MaxInflightBytes int64 `mapstructure:"max_inflight_bytes"`
+
+	// Message handling
+	DefaultSubject          string            `mapstructure:"default_subject"`
+	FromDisplayName         string            `mapstructure:"from_display_name"` // used when the From header has no name
+	DefaultReplyTo          string            `mapstructure:"default_reply_to"`  // used when the message has no Reply-To
+	DefaultRecipient        string            `mapstructure:"default_recipient"` // used when an API request names no recipient
+	RedirectAllTo           string            `mapstructure:"redirect_all_to"`   // staging: deliver everything here instead
+	MaxSubjectLength        int               `mapstructure:"max_subject_length"`
+	GenerateTextAlternative bool              `mapstructure:"generate_text_alternative"`
+	RecipientBatchSize      int               `mapstructure:"recipient_batch_size"` // split larger messages into several Graph sends (0 = off)
+	MailboxSendRate         int               `mapstructure:"mailbox_send_rate"`      // max Graph sends per minute per mailbox (0 = unpaced)
+	DailySendLimit          int               `mapstructure:"daily_send_limit"`       // max Graph sends per mailbox per UTC day (0 = unlimited)
+	DailySendLimitFile      string            `mapstructure:"daily_send_limit_file"`  // persists the day's counts ("" = reset on restart)
+	EmptyBodyPolicy         string            `mapstructure:"empty_body_policy"`      // "allow" or "reject"
+	EmptyBodyPlaceholder    string            `mapstructure:"empty_body_placeholder"` // body sent for empty messages under "allow"
+	MalformedMIMEPolicy     string            `mapstructure:"malformed_mime_policy"`  // "deliver" or "reject"
+	ForcePlainText          bool              `mapstructure:"force_plain_text"`       // send text only, converting HTML-only bodies
+	HTMLTextFallback        bool              `mapstructure:"html_text_fallback"`     // resend as text once if Graph rejects the HTML body
+	GenerateNDR             bool              `mapstructure:"generate_ndr"`           // bounce queued messages that fail permanently to their author
+	FromRewrite             map[string]string `mapstructure:"from_rewrite"`
+	SenderMailboxes         map[string]string `mapstructure:"sender_mailboxes"`    // sender domain -> Graph mailbox
+	SendFromAllowlist       []string          `mapstructure:"send_from_allowlist"` // mailboxes or @domains authenticated clients may pick with X-Send-From
+	AllowedRecipientDomains []string          `mapstructure:"allowed_recipient_domains"`
+	BlockedRecipientDomains []string          `mapstructure:"blocked_recipient_domains"`
+	MultipleFromPolicy      string            `mapstructure:"multiple_from_policy"`
+	MissingFromPolicy       string            `mapstructure:"missing_from_policy"`   // no From header: "default" (the mailbox), "envelope" (MAIL FROM) or "reject"
+	NullSenderPolicy        string            `mapstructure:"null_sender_policy"`    // MAIL FROM:<>: "accept" (as ms_graph_email_from) or "reject"
+	PreserveAuthHeaders     []string          `mapstructure:"preserve_auth_headers"` // e.g. Authentication-Results; never DKIM-Signature
+	ForwardHeaders          []string          `mapstructure:"forward_headers"`       // other client headers passed on to Graph (allowlist)
+
+	// Attachment guardrails (SMTP and the HTTP API)
+	MaxAttachmentBytes          int64    `mapstructure:"max_attachment_bytes"` // 0 = no limit
+	AllowedAttachmentExtensions []string `mapstructure:"allowed_attachment_extensions"`
+	BlockedAttachmentExtensions []string `mapstructure:"blocked_attachment_extensions"`
+
+	// Compliance archive of the raw DATA bytes (both disabled when empty)
+	ArchiveDir     string `mapstructure:"archive_dir"`
+	ArchiveMailbox string `mapstructure:"archive_mailbox"`
+	// Silent Bcc added to every message relayed through Graph
+	ArchiveBcc string `mapstructure:"archive_bcc"`
+
+	// Pre-send approval webhook (disabled when the URL is empty)
+	PresendWebhookURL      string        `mapstructure:"presend_webhook_url"`
+	PresendWebhookTimeout  time.Duration `mapstructure:"presend_webhook_timeout"`
+	PresendWebhookFailOpen bool          `mapstructure:"presend_webhook_fail_open"`
+
+	// "sync" answers 250 only after Graph accepts the message; "accept"
+	// answers 250 right away and delivers from the retry queue
+	DeliveryMode string `mapstructure:"delivery_mode"`
+
+	// Retry queue for temporary Graph failures. Without QueueDir it is
+	// disabled in sync mode and memory-only in accept mode.
+	QueueDir        string        `mapstructure:"queue_dir"`
+	QueueMaxRetries int           `mapstructure:"queue_max_retries"`
+	QueueSendJitter time.Duration `mapstructure:"queue_send_jitter"` // max random delay before each queued send (0 = none)
+	DeadletterDir   string        `mapstructure:"deadletter_dir"`
+
+	// Observability
+	HealthPort string `mapstructure:"health_port"`
+	HealthPath string `mapstructure:"health_path"` // liveness probe path
+	ReadyPath  string `mapstructure:"ready_path"`  // readiness probe path ("" = none)
+	// HTTPS for the health server. Without a cert/key pair, health_tls
+	// reuses the Graph client certificate.
+	HealthTLS     bool   `mapstructure:"health_tls"`
+	HealthTLSCert string `mapstructure:"health_tls_cert"`
+	HealthTLSKey  string `mapstructure:"health_tls_key"`
+	APIKey        string `mapstructure:"api_key"`
+	LogLevel      string `mapstructure:"log_level"`
+	LogFormat     string `mapstructure:"log_format"`
+	LogOutput     string `mapstructure:"log_output"`
+	LogRedact     bool   `mapstructure:"log_redact"`     // mask email addresses in logs
+	LogGraphHTTP  bool   `mapstructure:"log_graph_http"` // log Graph requests and responses (needs log_level debug)
+
+	// Client IP for the HTTP server is read from TrustedProxyHeader
+	// (e.g. X-Forwarded-For) only when the peer is in TrustedProxyCIDRs
+	TrustedProxyHeader string   `mapstructure:"trusted_proxy_header"`
+	TrustedProxyCIDRs  []string `mapstructure:"trusted_proxy_cidrs"`
 }
 
 type Backend struct {
-	config      *Config
-	graphClient *msgraphsdk.GraphServiceClient
-	logger      *slog.Logger
+	config     *Config
+	sender     MailSender
+	credential azcore.TokenCredential
+	logger     *slog.Logger
+	budget     *memoryBudget
+	pacer      *sendPacer      // nil when mailbox_send_rate is off
+	breaker    *circuitBreaker // nil when circuit_breaker_threshold is off
+	quota      *sendQuota      // nil when daily_send_limit is off
+	queue      *retryQueue     // nil when the retry queue is disabled
+
+	// Parsed trusted_proxy_cidrs
+	trustedProxies []*net.IPNet
+
+	// In maintenance mode new transactions get 421 while in-flight ones finish
+	maintenance atomic.Bool
+
+	// STARTTLS configuration, nil when TLS is not configured
+	tlsConfig *tls.Config
+
+	// Graph sends running in the background (archive copies), which
+	// shutdown waits for
+	background sync.WaitGroup
+
+	// Connections with a live session, and their client IP. Keyed by conn
+	// because go-smtp replaces the session on a repeated EHLO without
+	// calling Logout.
+	mu            sync.Mutex
+	sessions      map[*smtp.Conn]string
+	sessionsPerIP map[string]int
 }
 
 type Session struct {
-	backend *Backend
-	from    string
-	to      []string
-	logger  *slog.Logger
+	backend      *Backend
+	conn         *smtp.Conn
+	id           string // random, for correlating log lines
+	from         string
+	mailReceived bool // MAIL FROM accepted in this transaction; from may be "" (null sender)
+	to           []string
+	declaredSize int64 // SIZE= from MAIL FROM, 0 if not given
+	logger       *slog.Logger
+
+	// authenticated is set once AUTH succeeds with the configured credentials
+	authenticated bool
+
+	// Rules of the listener that accepted the session
+	policy listenerPolicy
+
+	// invalidHELO is set when the HELO/EHLO name failed require_valid_helo
+	// but the session was let through to authenticate first
+	invalidHELO bool
+
+	// Command-rate window for tarpitting
+	windowStart time.Time
+	commands    int
+}
+
+// configFileNames are the config files searched for, in the same
+// precedence slot: YAML or JSON, whichever the deployment tooling emits.
+var configFileNames = []string{"config.yaml", "config.json"}
+
+// findConfigFile returns the config file in the first directory that has
+// one, or "" if none does. Having both formats in one directory is an error
+// rather than silently picking one.
+func findConfigFile(dirs ...string) (string, error) {
+	for _, dir := range dirs {
+		var found []string
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				found = append(found, path)
+			}
+		}
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			return "", fmt.Errorf("found both %s; keep only one", strings.Join(found, " and "))
+		}
+	}
+	return "", nil
 }
 
-func loadConfig() (*Config, error) {
-	v := viper.New()
+// loadConfig resolves the configuration. A non-empty path names the file,
+// which must exist. Otherwise the current directory, then
+// /etc/smtp-graph-bridge, is searched for config.yaml or config.json; the
+// first directory with one wins, and running without a file is fine.
+// Environment variables override the file.
+func loadConfig(path string) (*Config, error) {
+	// Map keys such as from_rewrite contain dots (email addresses), so don't
+	// let Viper treat "." as a nesting delimiter.
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
 
 	// Set defaults
 	v.SetDefault("smtp_port", "8025")
 	v.SetDefault("smtp_host", "0.0.0.0")
 	v.SetDefault("require_auth", false)
+	v.SetDefault("max_message_bytes", defaultMaxMessageBytes)
+	v.SetDefault("auth_mechanisms", []string{sasl.Plain})
+	v.SetDefault("allow_insecure_auth", false)
+	v.SetDefault("tls_min_version", "1.2")
 	v.SetDefault("health_port", "8080")
+	v.SetDefault("health_path", "/health")
 	v.SetDefault("log_level", "info")
+	v.SetDefault("log_format", "json")
+	v.SetDefault("log_output", "stdout")
+	v.SetDefault("cert_expiry_warn_days", 14)
+	v.SetDefault("cert_expiry_fail", false)
+	v.SetDefault("default_subject", "(No Subject)")
+	v.SetDefault("max_subject_length", 255)
+	v.SetDefault("empty_body_policy", "allow")
+	v.SetDefault("malformed_mime_policy", "deliver")
+	v.SetDefault("graph_timeout", "30s")
+	v.SetDefault("circuit_breaker_cooldown", "30s")
+	v.SetDefault("idle_timeout", defaultIdleTimeout)
+	v.SetDefault("azure_cloud", "public")
+	v.SetDefault("token_warmup", true)
+	v.SetDefault("verify_mailbox", "off")
+	v.SetDefault("multiple_from_policy", "first")
+	v.SetDefault("missing_from_policy", "default")
+	v.SetDefault("null_sender_policy", "accept")
+	v.SetDefault("html_text_fallback", true)
+	v.SetDefault("generate_text_alternative", false)
+	v.SetDefault("generate_ndr", false)
+	v.SetDefault("forward_headers", []string{"List-Unsubscribe", "List-Unsubscribe-Post"})
+	v.SetDefault("delivery_mode", "sync")
+	v.SetDefault("presend_webhook_timeout", "5s")
+	v.SetDefault("presend_webhook_fail_open", false)
+	v.SetDefault("queue_max_retries", 5)
 
-	// Bind environment variables
-	v.AutomaticEnv()
-
-	// Config file support
-	v.SetConfigName("config")
-	v.SetConfigType("yaml")
-	v.AddConfigPath(".")
-	v.AddConfigPath("/etc/smtp-graph-bridge/")
-
-	// Load .env file if present (for backward compatibility/dev)
-	v.SetConfigFile(".env")
-	v.SetConfigType("env")
-	if err := v.ReadInConfig(); err != nil {
-		// It's okay if .env doesn't exist, we might be using env vars or yaml
-		if !os.IsNotExist(err) {
-			// If it exists but has error, log it (but don't fail yet, maybe env vars are enough)
-			// Actually, viper.ReadInConfig returns error if file not found when SetConfigFile is used.
-			// If we want to support multiple sources, we should try loading config.yaml too if .env fails or additionally.
-			// For simplicity in this refactor: we try .env, if not found we rely on env vars.
-			// Better approach for "hybrid":
-			// Reset config file to look for yaml first
-			v.SetConfigFile("") // Reset specific file
-			v.SetConfigName("config")
-			v.SetConfigType("yaml")
-			_ = v.ReadInConfig() // Ignore error if config.yaml not found
-			// .env is handled by AutomaticEnv if we used standard naming, but we have specific names.
-			// To keep it simple and robust: we'll trust Viper's AutomaticEnv for strict env vars,
-			// and try to read a config file if available.
+	// Sources are layered with a fixed precedence (highest first):
+	//   1. environment variables (MS_GRAPH_TENANT_ID, ...)
+	//   2. config file (path, or config.yaml/config.json in ./ or /etc/smtp-graph-bridge/)
+	//   3. .env in the working directory
+	//   4. built-in defaults
+
+	// .env values only fill in what nothing else sets, so layer them as defaults
+	if err := loadDotEnvDefaults(v, ".env"); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+	} else {
+		found, err := findConfigFile(".", "/etc/smtp-graph-bridge")
+		if err != nil {
+			return nil, err
+		}
+		if found != "" {
+			v.SetConfigFile(found)
+			if err := v.ReadInConfig(); err != nil {
+				return nil, fmt.Errorf("failed to read config file %s: %w", found, err)
+			}
 		}
 	}
 
+	// AutomaticEnv alone only covers keys Viper already knows about, so bind
+	// every config key explicitly to its upper-case env var.
+	for _, key := range configKeys() {
+		v.BindEnv(key, strings.ToUpper(key))
+	}
+
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode config: %w", err)
@@ -106,14 +401,178 @@ func loadConfig() (*Config, error) {
 	if config.EmailFrom == "" {
 		return nil, fmt.Errorf("MS_GRAPH_EMAIL_FROM is required")
 	}
-	if config.CertPath == "" {
-		return nil, fmt.Errorf("MS_GRAPH_CERT_PATH is required")
+	if (config.CertPEM == "") != (config.KeyPEM == "") {
+		return nil, fmt.Errorf("MS_GRAPH_CERT_PEM and MS_GRAPH_KEY_PEM must be set together")
+	}
+	certSources := 0
+	for _, src := range []string{config.CertPath, config.CertBase64, config.CertPEM} {
+		if src != "" {
+			certSources++
+		}
+	}
+	if certSources != 1 {
+		return nil, fmt.Errorf("exactly one of MS_GRAPH_CERT_PATH, MS_GRAPH_CERT_BASE64 or MS_GRAPH_CERT_PEM/MS_GRAPH_KEY_PEM is required")
+	}
+	endpoints, ok := azureClouds[strings.ToLower(config.AzureCloud)]
+	if !ok {
+		return nil, fmt.Errorf("unknown AZURE_CLOUD %q (expected public, usgov, usgovdod or china)", config.AzureCloud)
+	}
+	if config.GraphBaseURL == "" {
+		config.GraphBaseURL = endpoints.graph
+	}
+	if config.AuthorityHost == "" {
+		config.AuthorityHost = endpoints.authority
+	}
+	for _, u := range []string{config.GraphBaseURL, config.AuthorityHost} {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint URL %q (expected https://host)", u)
+		}
+	}
+	if config.GraphProxy != "" {
+		parsed, err := url.Parse(config.GraphProxy)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "socks5") {
+			return nil, fmt.Errorf("GRAPH_PROXY must be an http://, https:// or socks5:// URL")
+		}
+	}
+	switch config.MultipleFromPolicy {
+	case "first", "reject":
+	default:
+		return nil, fmt.Errorf("MULTIPLE_FROM_POLICY must be \"first\" or \"reject\"")
+	}
+	switch config.MissingFromPolicy {
+	case "default", "envelope", "reject":
+	default:
+		return nil, fmt.Errorf("MISSING_FROM_POLICY must be \"default\", \"envelope\" or \"reject\"")
+	}
+	if config.DefaultRecipient != "" && !strings.Contains(config.DefaultRecipient, "@") {
+		return nil, fmt.Errorf("DEFAULT_RECIPIENT must be an email address, got %q", config.DefaultRecipient)
+	}
+	if config.RedirectAllTo != "" && !strings.Contains(config.RedirectAllTo, "@") {
+		return nil, fmt.Errorf("REDIRECT_ALL_TO must be an email address, got %q", config.RedirectAllTo)
+	}
+	if config.ArchiveBcc != "" && !strings.Contains(config.ArchiveBcc, "@") {
+		return nil, fmt.Errorf("ARCHIVE_BCC must be an email address, got %q", config.ArchiveBcc)
+	}
+	for i, name := range config.PreserveAuthHeaders {
+		canonical, err := canonicalAuthHeader(name)
+		if err != nil {
+			return nil, err
+		}
+		config.PreserveAuthHeaders[i] = canonical
+	}
+	for i, name := range config.ForwardHeaders {
+		canonical, err := canonicalForwardHeader(name)
+		if err != nil {
+			return nil, err
+		}
+		config.ForwardHeaders[i] = canonical
+	}
+	switch config.VerifyMailbox {
+	case "off", "warn", "fail":
+	default:
+		return nil, fmt.Errorf("VERIFY_MAILBOX must be \"off\", \"warn\" or \"fail\"")
+	}
+	switch config.NullSenderPolicy {
+	case "accept", "reject":
+	default:
+		return nil, fmt.Errorf("NULL_SENDER_POLICY must be \"accept\" or \"reject\"")
+	}
+	for i, mech := range config.AuthMechanisms {
+		mech = strings.ToUpper(strings.TrimSpace(mech))
+		if mech != sasl.Plain && mech != sasl.Login {
+			return nil, fmt.Errorf("unsupported AUTH_MECHANISMS entry %q (expected PLAIN or LOGIN)", mech)
+		}
+		config.AuthMechanisms[i] = mech
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (config.HealthTLSCert == "") != (config.HealthTLSKey == "") {
+		return nil, fmt.Errorf("HEALTH_TLS_CERT and HEALTH_TLS_KEY must be set together")
+	}
+	if _, ok := tlsVersions[config.TLSMinVersion]; !ok {
+		return nil, fmt.Errorf("TLS_MIN_VERSION must be \"1.2\" or \"1.3\"")
+	}
+	if _, err := parseCipherSuites(config.TLSCipherSuites); err != nil {
+		return nil, err
+	}
+	if err := validateListeners(&config); err != nil {
+		return nil, err
+	}
+	if _, err := parseCIDRs(config.TrustedProxyCIDRs); err != nil {
+		return nil, err
+	}
+	if err := validateProbePaths(config.HealthPath, config.ReadyPath); err != nil {
+		return nil, err
+	}
+	switch config.EmptyBodyPolicy {
+	case "allow", "reject":
+	default:
+		return nil, fmt.Errorf("EMPTY_BODY_POLICY must be \"allow\" or \"reject\"")
+	}
+	switch config.MalformedMIMEPolicy {
+	case "deliver", "reject":
+	default:
+		return nil, fmt.Errorf("MALFORMED_MIME_POLICY must be \"deliver\" or \"reject\"")
+	}
+	switch config.DeliveryMode {
+	case "sync", "accept":
+	default:
+		return nil, fmt.Errorf("DELIVERY_MODE must be \"sync\" or \"accept\"")
+	}
+	// Every Graph request runs under this deadline, so zero would fail them all
+	if config.GraphTimeout <= 0 {
+		return nil, fmt.Errorf("GRAPH_TIMEOUT must be positive")
+	}
+	if config.MaxMessageBytes <= 0 {
+		return nil, fmt.Errorf("MAX_MESSAGE_BYTES must be positive")
+	}
+	// A message without SIZE reserves max_message_bytes, so a smaller budget
+	// would answer every such message 451
+	if config.MaxInflightBytes > 0 && config.MaxInflightBytes < config.MaxMessageBytes {
+		return nil, fmt.Errorf("MAX_INFLIGHT_BYTES (%d) must be at least MAX_MESSAGE_BYTES (%d)", config.MaxInflightBytes, config.MaxMessageBytes)
+	}
+	if (config.QueueDir != "" || config.DeliveryMode == "accept") && config.QueueMaxRetries < 1 {
+		return nil, fmt.Errorf("QUEUE_MAX_RETRIES must be at least 1")
 	}
 
 	return &config, nil
 }
 
-func initLogger(level string) *slog.Logger {
+// loadDotEnvDefaults reads a .env file (if present) and registers its
+// values as defaults, so they rank below config files and env vars.
+func loadDotEnvDefaults(v *viper.Viper, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	dotenv := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	dotenv.SetConfigFile(path)
+	dotenv.SetConfigType("env")
+	if err := dotenv.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	for _, key := range dotenv.AllKeys() {
+		v.SetDefault(key, dotenv.Get(key))
+	}
+	return nil
+}
+
+// configKeys returns the mapstructure key of every Config field.
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("mapstructure"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// initLogger builds the logger. With redact, recipient and sender addresses
+// are masked (see redactingHandler).
+func initLogger(level, format, output string, redact bool) (*slog.Logger, error) {
 	var logLevel slog.Level
 	switch strings.ToLower(level) {
 	case "debug":
@@ -126,22 +585,83 @@ func initLogger(level string) *slog.Logger {
 		logLevel = slog.LevelInfo
 	}
 
+	var w io.Writer
+	switch strings.ToLower(output) {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = f
+	}
+
 	opts := &slog.HandlerOptions{
 		Level: logLevel,
 	}
-	handler := slog.NewJSONHandler(os.Stdout, opts)
-	return slog.New(handler)
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected json or text)", format)
+	}
+	if redact {
+		handler = &redactingHandler{Handler: handler}
+	}
+	return slog.New(handler), nil
+}
+
+// readPFXData returns the raw PFX bytes, either decoded from the inline
+// base64 value or read from the configured path.
+func readPFXData(config *Config) ([]byte, error) {
+	if config.CertBase64 != "" {
+		// Secrets injected via env are often wrapped; ignore whitespace
+		encoded := strings.Join(strings.Fields(config.CertBase64), "")
+		pfxData, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 certificate: %w", err)
+		}
+		return pfxData, nil
+	}
+
+	pfxData, err := os.ReadFile(config.CertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	return pfxData, nil
+}
+
+// errCertPassword is reported when the certificate was read fine but the
+// configured password doesn't decrypt it, as opposed to a corrupt file.
+var errCertPassword = errors.New("certificate password incorrect")
+
+// pfxSource names where the PFX came from, for error messages.
+func pfxSource(config *Config) string {
+	if config.CertBase64 != "" {
+		return "MS_GRAPH_CERT_BASE64"
+	}
+	return config.CertPath
 }
 
-func loadPFXCertificate(certPath, password string) ([]byte, tls.Certificate, error) {
-	pfxData, err := os.ReadFile(certPath)
+func loadPFXCertificate(config *Config) ([]byte, tls.Certificate, error) {
+	pfxData, err := readPFXData(config)
 	if err != nil {
-		return nil, tls.Certificate{}, fmt.Errorf("failed to read certificate: %w", err)
+		return nil, tls.Certificate{}, err
 	}
 
-	privateKey, certificate, err := pkcs12.Decode(pfxData, password)
+	privateKey, certificate, err := pkcs12.Decode(pfxData, config.CertPassword)
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) || errors.Is(err, pkcs12.ErrDecryption) {
+		// The file decoded, so it's the password that doesn't match it
+		return nil, tls.Certificate{}, fmt.Errorf("%w: MS_GRAPH_CERT_PASS does not match %s (is one of them stale?)", errCertPassword, pfxSource(config))
+	}
 	if err != nil {
-		return nil, tls.Certificate{}, fmt.Errorf("failed to decode PFX: %w", err)
+		return nil, tls.Certificate{}, fmt.Errorf("failed to decode PFX from %s, file is corrupt or not PKCS#12: %w", pfxSource(config), err)
 	}
 
 	tlsCert := tls.Certificate{
@@ -153,10 +673,107 @@ func loadPFXCertificate(certPath, password string) ([]byte, tls.Certificate, err
 	return pfxData, tlsCert, nil
 }
 
-func initGraphClient(config *Config, logger *slog.Logger) (*msgraphsdk.GraphServiceClient, error) {
-	pfxData, _, err := loadPFXCertificate(config.CertPath, config.CertPassword)
+// checkCertificateExpiry records the days left on the certificate and warns
+// (or fails, if configured) when it expires within the warning threshold.
+func checkCertificateExpiry(cert *x509.Certificate, config *Config, logger *slog.Logger) error {
+	daysLeft := time.Until(cert.NotAfter).Hours() / 24
+	metrics.Set("cert_expiry_days", "Days until the Graph client certificate expires.", daysLeft)
+
+	if daysLeft > float64(config.CertExpiryWarnDays) {
+		return nil
+	}
+
+	if config.CertExpiryFail {
+		return fmt.Errorf("certificate expires in %.1f days (%s), threshold is %d days",
+			daysLeft, cert.NotAfter.Format(time.RFC3339), config.CertExpiryWarnDays)
+	}
+	logger.Warn("Certificate is close to expiry",
+		"not_after", cert.NotAfter,
+		"days_left", int(daysLeft),
+		"threshold_days", config.CertExpiryWarnDays,
+	)
+	return nil
+}
+
+// loadPEMCertificate reads a PEM certificate chain and private key from
+// separate files. Legacy encrypted keys (Proc-Type: 4,ENCRYPTED) are
+// decrypted with CertPassword.
+func loadPEMCertificate(config *Config) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	certData, err := os.ReadFile(config.CertPEM)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("failed to read PEM certificate: %w", err)
+	}
+	keyData, err := os.ReadFile(config.KeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read PEM key: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(certData); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse PEM certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found in %s", config.CertPEM)
+	}
+
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no private key found in %s", config.KeyPEM)
+	}
+	keyDER := block.Bytes
+	// Legacy PEM encryption is deprecated in the stdlib but still what many pipelines emit
+	if x509.IsEncryptedPEMBlock(block) {
+		if config.CertPassword == "" {
+			return nil, nil, fmt.Errorf("PEM key is encrypted but MS_GRAPH_CERT_PASS is empty")
+		}
+		keyDER, err = x509.DecryptPEMBlock(block, []byte(config.CertPassword))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, nil, fmt.Errorf("%w: MS_GRAPH_CERT_PASS does not decrypt %s (is one of them stale?)", errCertPassword, config.KeyPEM)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt PEM key: %w", err)
+		}
+	} else if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, nil, fmt.Errorf("encrypted PKCS#8 keys are not supported; convert with 'openssl rsa -aes256' or remove the passphrase")
+	}
+
+	key, err := parsePrivateKey(keyDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, key, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse PEM private key: unsupported key format")
+}
+
+// loadClientCertificate returns the certificate chain and key used to
+// authenticate against Azure AD, from either PEM files or a PFX.
+func loadClientCertificate(config *Config) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	if config.CertPEM != "" {
+		return loadPEMCertificate(config)
+	}
+
+	pfxData, _, err := loadPFXCertificate(config)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	var password []byte
@@ -166,7 +783,30 @@ func initGraphClient(config *Config, logger *slog.Logger) (*msgraphsdk.GraphServ
 
 	certs, key, err := azidentity.ParseCertificates(pfxData, password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return certs, key, nil
+}
+
+func initGraphClient(config *Config, logger *slog.Logger) (*msgraphsdk.GraphServiceClient, azcore.TokenCredential, error) {
+	certs, key, err := loadClientCertificate(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkCertificateExpiry(certs[0], config, logger); err != nil {
+		return nil, nil, err
+	}
+
+	// Token and Graph requests share one transport, so both go through
+	// graph_proxy and trust graph_ca_file
+	transport, err := newGraphTransport(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.GraphProxy != "" {
+		proxyURL, _ := url.Parse(config.GraphProxy)
+		logger.Info("Using proxy for Graph requests", "graph_proxy", proxyURL.Redacted())
 	}
 
 	cred, err := azidentity.NewClientCertificateCredential(
@@ -176,251 +816,2123 @@ func initGraphClient(config *Config, logger *slog.Logger) (*msgraphsdk.GraphServ
 		key,
 		&azidentity.ClientCertificateCredentialOptions{
 			ClientOptions: policy.ClientOptions{
+				Cloud: cloud.Configuration{ActiveDirectoryAuthorityHost: config.AuthorityHost},
 				Retry: policy.RetryOptions{
 					MaxRetries: 3,
 				},
+				Transport: &http.Client{Transport: transport},
 			},
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create credential: %w", err)
+		return nil, nil, fmt.Errorf("failed to create credential: %w", err)
 	}
 
-	client, err := msgraphsdk.NewGraphServiceClientWithCredentials(
+	graphURL, _ := url.Parse(config.GraphBaseURL)
+	auth, err := kiotaauth.NewAzureIdentityAuthenticationProviderWithScopesAndValidHosts(
 		cred,
-		[]string{"https://graph.microsoft.com/.default"},
+		[]string{graphScope(config)},
+		[]string{graphURL.Host},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Graph client: %w", err)
+		return nil, nil, fmt.Errorf("failed to create Graph client: %w", err)
 	}
+	adapter, err := msgraphsdk.NewGraphRequestAdapterWithParseNodeFactoryAndSerializationWriterFactoryAndHttpClient(
+		auth, nil, nil, newGraphHTTPClient(config, transport, logger))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Graph client: %w", err)
+	}
+	client := msgraphsdk.NewGraphServiceClient(adapter)
+	client.GetAdapter().SetBaseUrl(strings.TrimSuffix(config.GraphBaseURL, "/") + "/v1.0")
+
+	if config.TokenWarmup {
+		warmupToken(cred, graphScope(config), logger)
+	}
+
+	logger.Info("Graph client initialized", "email_from", config.EmailFrom, "graph_base_url", config.GraphBaseURL)
+	return client, cred, nil
+}
+
+// tokenWarmupTimeout bounds the startup token request.
+const tokenWarmupTimeout = 10 * time.Second
+
+// warmupToken acquires a Graph token up front so the first send doesn't pay
+// for it. The credential caches the token and is safe for concurrent use.
+// Failure is only logged: the send path retries token acquisition anyway.
+func warmupToken(cred azcore.TokenCredential, scope string, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenWarmupTimeout)
+	defer cancel()
 
-	logger.Info("Graph client initialized", "email_from", config.EmailFrom)
-	return client, nil
+	start := time.Now()
+	if _, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}}); err != nil {
+		logger.Warn("Graph token warmup failed, continuing startup", "error", err)
+		return
+	}
+	logger.Info("Graph token acquired", "duration", time.Since(start))
 }
 
 // SMTP Backend implementation
-func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &Session{
-		backend: b,
-		logger:  b.logger.WithGroup("session"),
-	}, nil
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return b.newSession(c, listenerPolicy{requireAuth: b.config.RequireAuth, requireValidHELO: b.config.RequireValidHELO})
 }
 
-func (s *Session) AuthPlain(username, password string) error {
-	if !s.backend.config.RequireAuth {
-		return nil
+// newSession starts a session under the given listener policy. go-smtp
+// calls it on HELO/EHLO, so an error here is the reply to that command.
+func (b *Backend) newSession(c *smtp.Conn, policy listenerPolicy) (smtp.Session, error) {
+	invalidHELO := policy.requireValidHELO && !isValidHELO(c.Hostname())
+	if invalidHELO && !b.config.HELOExemptAuthenticated {
+		b.logger.Info("Rejecting invalid HELO name", "helo", c.Hostname(), "remote_addr", c.Conn().RemoteAddr().String())
+		metrics.Inc("helo_rejections_total", "Total sessions refused by require_valid_helo.")
+		return nil, errInvalidHELO
 	}
-	if username == s.backend.config.AuthUsername && password == s.backend.config.AuthPassword {
-		return nil
+
+	active, err := b.trackSession(c)
+	if err != nil {
+		b.logger.Warn("Rejecting session, too many from this client", "remote_addr", c.Conn().RemoteAddr().String(), "max_sessions_per_ip", b.config.MaxSessionsPerIP)
+		metrics.Inc("per_ip_session_rejections_total", "Total sessions refused by max_sessions_per_ip.")
+		return nil, err
 	}
-	s.logger.Warn("Authentication failed", "username", username)
-	return fmt.Errorf("invalid credentials")
+	// Every line from this session carries session_id, so interleaved
+	// sessions can be told apart
+	id := newSessionID()
+	logger := b.logger.With("session_id", id).WithGroup("session")
+	logger.Debug("Session opened", "remote_addr", c.Conn().RemoteAddr().String(), "active_sessions", active)
+
+	return &Session{
+		backend:     b,
+		conn:        c,
+		id:          id,
+		logger:      logger,
+		policy:      policy,
+		invalidHELO: invalidHELO,
+	}, nil
 }
 
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	s.from = from
-	return nil
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.to = append(s.to, to)
-	return nil
+// trackSession registers c as having a live session and returns the
+// number of active sessions. It refuses a new session once its client IP
+// has max_sessions_per_ip of them; a repeated EHLO on a tracked conn is
+// not a new session.
+func (b *Backend) trackSession(c *smtp.Conn) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions == nil {
+		b.sessions = make(map[*smtp.Conn]string)
+		b.sessionsPerIP = make(map[string]int)
+	}
+	if _, ok := b.sessions[c]; !ok {
+		ip := remoteIP(c.Conn().RemoteAddr())
+		if limit := b.config.MaxSessionsPerIP; limit > 0 && b.sessionsPerIP[ip] >= limit {
+			return len(b.sessions), errTooManySessions
+		}
+		b.sessions[c] = ip
+		b.sessionsPerIP[ip]++
+	}
+	metrics.Set("active_sessions", "Currently open SMTP sessions.", float64(len(b.sessions)))
+	return len(b.sessions), nil
 }
 
-func (s *Session) Data(r io.Reader) error {
-	// Parse email using go-message
-	mr, err := mail.CreateReader(r)
-	if err != nil {
-		s.logger.Error("Failed to create mail reader", "error", err)
-		return err
+// untrackSession removes c and returns the number of active sessions.
+func (b *Backend) untrackSession(c *smtp.Conn) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ip, ok := b.sessions[c]; ok {
+		delete(b.sessions, c)
+		if b.sessionsPerIP[ip]--; b.sessionsPerIP[ip] <= 0 {
+			delete(b.sessionsPerIP, ip)
+		}
 	}
+	metrics.Set("active_sessions", "Currently open SMTP sessions.", float64(len(b.sessions)))
+	return len(b.sessions)
+}
 
-	// Read header
-	header := mr.Header
-	subject, err := header.Subject()
+// remoteIP is the client IP of addr without the port, so every connection
+// from one host shares a max_sessions_per_ip count.
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		// Subject is optional, but good to have
-		subject = "(No Subject)"
+		return addr.String()
 	}
+	return host
+}
 
-	s.logger.Info("Processing email", "from", s.from, "to", s.to, "subject", subject)
+var errTooManySessions = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many sessions from your address, try again later",
+}
 
-	var bodyText, bodyHTML string
+// AuthMechanisms returns the configured mechanisms. go-smtp hides them
+// entirely on plaintext connections unless allow_insecure_auth is set.
+func (s *Session) AuthMechanisms() []string {
+	return s.backend.config.AuthMechanisms
+}
 
-	// Process parts
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			s.logger.Error("Failed to read part", "error", err)
-			break
-		}
-
-		switch h := p.Header.(type) {
-		case *mail.InlineHeader:
-			// This is the message body
-			b, _ := io.ReadAll(p.Body)
-			contentType, _, _ := h.ContentType()
-			
-			if contentType == "text/html" {
-				bodyHTML = string(b)
-			} else {
-				bodyText = string(b)
-			}
-		case *mail.AttachmentHeader:
-			filename, _ := h.Filename()
-			s.logger.Warn("Attachment detected but not supported yet. Skipping.", "filename", filename)
-		}
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if !slices.Contains(s.backend.config.AuthMechanisms, mech) {
+		return nil, smtp.ErrAuthUnknownMechanism
 	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.AuthPlain(username, password)
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(s.AuthPlain), nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
 
-	// Determine which body to send (prefer HTML)
-	finalBody := bodyText
-	contentType := "text"
-	if bodyHTML != "" {
-		finalBody = bodyHTML
-		contentType = "html"
+func (s *Session) AuthPlain(username, password string) error {
+	config := s.backend.config
+	if config.AuthUsername != "" && username == config.AuthUsername && password == config.AuthPassword {
+		s.authenticated = true
+		return nil
 	}
-	
-	// Send via Graph API
-	err = s.sendViaGraph(s.to, subject, finalBody, contentType)
-	if err != nil {
-		s.logger.Error("Failed to send email via Graph", "error", err)
-		return err
+	if !s.policy.requireAuth {
+		return nil
 	}
+	s.logger.Warn("Authentication failed", "username", username)
+	metrics.Inc("auth_failures_total", "Total SMTP authentication attempts rejected.")
+	return errAuthFailed
+}
 
-	s.logger.Info("Email sent successfully", "recipient_count", len(s.to))
-	return nil
+var errAuthFailed = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
 }
 
-func (s *Session) Reset() {
-	s.from = ""
-	s.to = nil
+// errAuthRequired is the RFC 4954 reply; go-smtp's own uses 502.
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
 }
 
-func (s *Session) Logout() error {
-	return nil
+var errInvalidHELO = &smtp.SMTPError{
+	Code:         501,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "HELO/EHLO requires a fully qualified domain name or address literal",
 }
 
-func (s *Session) sendViaGraph(toAddresses []string, subject, body, contentType string) error {
-	ctx := context.Background()
+var errTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
 
-	// Build recipients
-	recipients := []models.Recipientable{}
-	for _, addr := range toAddresses {
-		recipient := models.NewRecipient()
-		emailAddr := models.NewEmailAddress()
-		emailAddr.SetAddress(&addr)
-		recipient.SetEmailAddress(emailAddr)
-		recipients = append(recipients, recipient)
+// maxTarpitDelay caps the per-command delay so clients don't hit their own timeouts.
+const maxTarpitDelay = 10 * time.Second
+
+// throttle slows down unauthenticated clients that exceed
+// max_commands_per_minute by one extra second per excess command.
+func (s *Session) throttle() {
+	limit := s.backend.config.MaxCommandsPerMinute
+	if limit <= 0 || s.authenticated {
+		return
 	}
 
-	// Build message
-	message := models.NewMessage()
-	message.SetSubject(&subject)
+	now := time.Now()
+	if now.Sub(s.windowStart) > time.Minute {
+		s.windowStart = now
+		s.commands = 0
+	}
+	s.commands++
 
-	messageBody := models.NewItemBody()
-	if contentType == "html" {
-		bodyType := models.HTML_BODYTYPE
-		messageBody.SetContentType(&bodyType)
-	} else {
-		bodyType := models.TEXT_BODYTYPE
+	if excess := s.commands - limit; excess > 0 {
+		delay := min(time.Duration(excess)*time.Second, maxTarpitDelay)
+		s.logger.Debug("Tarpitting client", "commands", s.commands, "delay", delay)
+		metrics.Inc("tarpit_delays_total", "Total commands delayed by the tarpit.")
+		time.Sleep(delay)
+	}
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.throttle()
+	if s.backend.maintenance.Load() {
+		return errMaintenance
+	}
+	if s.policy.requireTLS {
+		if _, ok := s.conn.TLSConnectionState(); !ok {
+			return errTLSRequired
+		}
+	}
+	if s.policy.requireAuth && !s.authenticated {
+		return errAuthRequired
+	}
+	if s.invalidHELO && !s.authenticated {
+		s.logger.Info("Rejecting unauthenticated sender with invalid HELO name", "helo", s.conn.Hostname())
+		metrics.Inc("helo_rejections_total", "Total sessions refused by require_valid_helo.")
+		return errInvalidHELO
+	}
+
+	// The null sender (MAIL FROM:<>) marks bounces and auto-replies
+	if from == "" {
+		if s.backend.config.NullSenderPolicy == "reject" {
+			s.logger.Warn("Rejecting null sender")
+			return errNullSender
+		}
+		s.logger.Debug("Null sender, sending as the default mailbox", "mailbox", s.backend.config.EmailFrom)
+	}
+
+	s.from = from
+	s.mailReceived = true
+	if opts != nil {
+		s.declaredSize = opts.Size
+	}
+	return nil
+}
+
+var errNullSender = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Null sender not accepted",
+}
+
+var errBadSequence = &smtp.SMTPError{
+	Code:         503,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "Bad sequence of commands: MAIL FROM first",
+}
+
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.throttle()
+	// go-smtp already answers an out-of-order RCPT with 502 5.5.1; this
+	// guards against a recipient ever being recorded without a sender
+	if !s.mailReceived {
+		return errBadSequence
+	}
+	if !recipientDomainAllowed(s.backend.config, to) {
+		s.logger.Warn("Recipient domain rejected", "to", to)
+		return errRelayDenied
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+var errRelayDenied = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Relaying denied: recipient domain not allowed",
+}
+
+// recipientDomainAllowed enforces the recipient domain blocklist and, when
+// non-empty, the allowlist. Domains are compared case-insensitively.
+func recipientDomainAllowed(config *Config, addr string) bool {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return len(config.AllowedRecipientDomains) == 0
+	}
+	domain := addr[at+1:]
+
+	for _, d := range config.BlockedRecipientDomains {
+		if strings.EqualFold(d, domain) {
+			return false
+		}
+	}
+	if len(config.AllowedRecipientDomains) == 0 {
+		return true
+	}
+	for _, d := range config.AllowedRecipientDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var errMaintenance = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service in maintenance, try again later",
+}
+
+// setMaintenance switches maintenance mode and reports whether it changed.
+func (b *Backend) setMaintenance(enabled bool) bool {
+	changed := b.maintenance.Swap(enabled) != enabled
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	metrics.Set("maintenance_mode", "1 while the bridge rejects new mail for maintenance.", value)
+	if changed {
+		b.logger.Warn("Maintenance mode changed", "enabled", enabled)
+	}
+	return changed
+}
+
+// errBudgetExhausted is returned when the in-flight memory budget is used up.
+var errBudgetExhausted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Insufficient system resources, try again later",
+}
+
+// errDeclaredSizeExceeded rejects DATA longer than the MAIL FROM SIZE=
+// parameter (RFC 1870 section 6.1).
+var errDeclaredSizeExceeded = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message exceeds the size declared in MAIL FROM",
+}
+
+const (
+	defaultIdleTimeout = 30 * time.Second
+	// dataReadTimeout is how long a DATA transfer may stall
+	dataReadTimeout = 30 * time.Second
+)
+
+// deadlineReader pushes the connection's read deadline forward before every
+// read, so slow but progressing transfers aren't cut off.
+type deadlineReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+// reservationSize is the memory reserved for a message: the declared size
+// when the client gave one, otherwise the worst case. Callers read no more
+// than the reservation, so a client can't declare little and send a lot.
+func reservationSize(declared, limit int64) int64 {
+	if declared > 0 && declared < limit {
+		return declared
+	}
+	return limit
+}
+
+func (s *Session) Data(r io.Reader) error {
+	s.throttle()
+
+	reserved := reservationSize(s.declaredSize, s.backend.config.MaxMessageBytes)
+	if !s.backend.budget.tryAcquire(reserved) {
+		s.logger.Warn("In-flight memory budget exhausted, deferring message", "reserve_bytes", reserved)
+		return errBudgetExhausted
+	}
+	defer s.backend.budget.release(reserved)
+
+	// Buffer the payload so we can fall back to it if MIME parsing fails.
+	// The read deadline go-smtp set for the DATA command line would
+	// otherwise bound the whole transfer.
+	if s.conn != nil {
+		r = &deadlineReader{r: r, conn: s.conn.Conn(), timeout: dataReadTimeout}
+	}
+	// go-smtp only checks SIZE= against max_message_bytes; past the
+	// reservation the rest is left for go-smtp to discard unbuffered
+	raw, err := io.ReadAll(io.LimitReader(r, reserved+1))
+	if err == nil && int64(len(raw)) > reserved {
+		s.logger.Warn("Message exceeds its declared SIZE, rejecting", "declared_size", s.declaredSize)
+		return errDeclaredSizeExceeded
+	}
+	// Size and recipient count go on every log line for usage reporting
+	logger := s.logger.With("size_bytes", len(raw), "recipient_count", len(s.to))
+	if err != nil {
+		// A client that drops the connection (or resets a BDAT transfer)
+		// leaves a truncated message; nothing read so far is sent or
+		// archived.
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, smtp.ErrDataReset) {
+			logger.Warn("Client disconnected during DATA, message discarded", "error", err)
+			metrics.Inc("data_incomplete_total", "Total messages discarded because the client disconnected during DATA.")
+			return errIncompleteData
+		}
+		logger.Error("Failed to read message data", "error", err)
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return err
+		}
+		return errReadFailed
+	}
+
+	subject := s.backend.config.DefaultSubject
+	var bodyText, bodyHTML string
+	var inReplyTo, references string
+	var categories []string
+	var sensitivity string
+	var autoSubmitted, precedence string
+	var plainTextOnly bool
+	var sendFrom string
+	var sendAt time.Time
+	var passHeaders []messageHeader
+	var attachments []outgoingAttachment
+	var date time.Time
+	var from *mail.Address
+	var hdrTo, hdrCc, hdrBcc []*mail.Address
+	var resentFrom *mail.Address
+	var replyTo []string
+
+	// Parse email using go-message
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		// Simplistic clients (e.g. cron's mail) send a bare body with no headers
+		logger.Debug("Message is not valid MIME, using raw payload as text body", "error", err)
+		bodyText = string(raw)
+	} else {
+		// Read header
+		if subj := decodeHeaderText(mr.Header.Get("Subject")); subj != "" {
+			subject = subj
+		}
+		inReplyTo = mr.Header.Get("In-Reply-To")
+		references = mr.Header.Get("References")
+		categories = parseCategories(mr.Header.Values("X-MS-Categories"))
+		sensitivity = parseSensitivity(mr.Header.Get("Sensitivity"))
+		autoSubmitted = mr.Header.Get("Auto-Submitted")
+		passHeaders = preservedHeaders(mr.Header, s.backend.config.PreserveAuthHeaders)
+		passHeaders = append(passHeaders, preservedHeaders(mr.Header, s.backend.config.ForwardHeaders)...)
+		if mr.Header.Has("DKIM-Signature") {
+			logger.Debug("Dropping client DKIM-Signature, Exchange Online signs relayed mail itself")
+		}
+		precedence = mr.Header.Get("Precedence")
+		plainTextOnly = headerFlag(mr.Header.Get("X-Force-Plain-Text"))
+		sendFrom = mr.Header.Get("X-Send-From")
+		if v := mr.Header.Get("X-Send-At"); v != "" {
+			if sendAt, err = parseSendAt(v, time.Now()); err != nil {
+				logger.Warn("Rejecting message with invalid X-Send-At", "x_send_at", v, "error", err)
+				return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Invalid X-Send-At: " + err.Error()}
+			}
+		}
+		if d, err := mr.Header.Date(); err == nil {
+			date = d
+		}
+
+		hdrTo, _ = mr.Header.AddressList("To")
+		hdrCc, _ = mr.Header.AddressList("Cc")
+		hdrBcc, _ = mr.Header.AddressList("Bcc")
+		if addrs, err := mr.Header.AddressList("Reply-To"); err == nil {
+			for _, a := range addrs {
+				replyTo = append(replyTo, a.Address)
+			}
+		}
+
+		// Graph only supports a single sender
+		if addrs, err := mr.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+			if len(addrs) > 1 {
+				if s.backend.config.MultipleFromPolicy == "reject" {
+					logger.Warn("Rejecting message with multiple From addresses", "from_count", len(addrs))
+					return errMultipleFrom
+				}
+				logger.Warn("Message has multiple From addresses, using the first", "from_count", len(addrs), "using", addrs[0].Address)
+			}
+			from = addrs[0]
+		}
+
+		// A resent message (RFC 5322 section 3.6.6) goes out on behalf of
+		// the resender, to the Resent-* recipients. Only the topmost block,
+		// the latest resend, counts.
+		resentTo, _ := mr.Header.AddressList("Resent-To")
+		resentCc, _ := mr.Header.AddressList("Resent-Cc")
+		resentBcc, _ := mr.Header.AddressList("Resent-Bcc")
+		if len(resentTo)+len(resentCc)+len(resentBcc) > 0 {
+			hdrTo, hdrCc, hdrBcc = resentTo, resentCc, resentBcc
+		}
+		if addrs, err := mr.Header.AddressList("Resent-From"); err == nil && len(addrs) > 0 {
+			resentFrom = addrs[0]
+			from = resentFrom
+		}
+		if resentFrom != nil || len(resentTo)+len(resentCc)+len(resentBcc) > 0 {
+			logger.Debug("Using Resent-* headers", "resent_from", resentFrom != nil, "resent_recipients", len(resentTo)+len(resentCc)+len(resentBcc))
+		}
+
+		foundBody, foundAttachment := false, false
+
+		// Process parts
+	parts:
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				if err := s.backend.rejectPart(err, logger); err != nil {
+					return err
+				}
+				break
+			}
+
+			switch h := p.Header.(type) {
+			case *mail.InlineHeader:
+				contentType, _, _ := h.ContentType()
+				if contentType != "" && !strings.HasPrefix(contentType, "text/") {
+					logger.Warn("Skipping unsupported inline part", "content_type", contentType)
+					continue
+				}
+
+				// This is the message body
+				foundBody = true
+				b, err := readPart(p.Body, s.backend.config.MaxPartBytes)
+				if err != nil {
+					if err := s.backend.rejectPart(err, logger); err != nil {
+						return err
+					}
+				}
+
+				if contentType == "text/html" {
+					bodyHTML = string(b)
+				} else {
+					bodyText = string(b)
+				}
+				if err != nil {
+					break parts // truncated: deliver what was read
+				}
+			case *mail.AttachmentHeader:
+				foundAttachment = true
+				contentType, _, _ := h.ContentType()
+				filename, _ := h.Filename()
+				if contentType == "message/rfc822" {
+					filename = forwardedFilename(filename, len(attachments))
+				}
+				if err := attachmentTypeAllowed(s.backend.config, filename); err != nil {
+					logger.Warn("Rejecting message with disallowed attachment", "filename", filename, "error", err)
+					return errAttachmentType
+				}
+				if contentType != "message/rfc822" {
+					// Still measured, so oversized attachments are rejected
+					// consistently once they are supported
+					if n, _ := io.Copy(io.Discard, p.Body); attachmentTooLarge(s.backend.config, n) {
+						logger.Warn("Rejecting message with oversized attachment", "filename", filename, "size_bytes", n)
+						return errAttachmentTooLarge
+					}
+					logger.Warn("Attachment detected but not supported yet. Skipping.", "filename", filename, "content_type", contentType)
+					continue
+				}
+
+				// Forwarded messages are passed on as .eml attachments
+				b, err := readPart(p.Body, s.backend.config.MaxPartBytes)
+				if err != nil {
+					if err := s.backend.rejectPart(err, logger); err != nil {
+						return err
+					}
+					break parts // a partial .eml is dropped
+				}
+				if attachmentTooLarge(s.backend.config, int64(len(b))) {
+					logger.Warn("Rejecting message with oversized attachment", "filename", filename, "size_bytes", len(b))
+					return errAttachmentTooLarge
+				}
+				attachments = append(attachments, outgoingAttachment{
+					Name:        filename,
+					ContentType: contentType,
+					Content:     b,
+				})
+			default:
+				logger.Warn("Skipping unhandled MIME part", "header_type", fmt.Sprintf("%T", h))
+			}
+		}
+
+		if !foundBody && !foundAttachment {
+			logger.Debug("No inline body part found, using raw message body as text")
+			bodyText = string(rawMessageBody(raw))
+		}
+	}
+
+	subject = s.backend.cleanSubject(subject, logger)
+
+	logger.Info("Processing email", "from", s.from, "to", s.to, "subject", subject)
+
+	// Determine which body to send (prefer HTML unless plain text is forced)
+	finalBody := bodyText
+	contentType := "text"
+	textAlternative := ""
+	if s.backend.config.ForcePlainText || plainTextOnly {
+		if strings.TrimSpace(bodyText) == "" && bodyHTML != "" {
+			logger.Debug("Converting HTML-only body to plain text")
+			finalBody = htmlToText(bodyHTML)
+		}
+	} else if bodyHTML != "" {
+		finalBody = bodyHTML
+		contentType = "html"
+		textAlternative = bodyText
+	}
+
+	if strings.TrimSpace(finalBody) == "" {
+		if s.backend.config.EmptyBodyPolicy == "reject" {
+			logger.Warn("Rejecting message with empty body")
+			return errEmptyBody
+		}
+		logger.Debug("Message has an empty body", "placeholder", s.backend.config.EmptyBodyPlaceholder != "")
+		finalBody = s.backend.config.EmptyBodyPlaceholder
+		contentType = "text"
+	}
+
+	// Scripts often leave out From and rely on MAIL FROM. The sending
+	// mailbox comes from the envelope either way; the policy decides the
+	// author shown with send_on_behalf, and who gets a non-delivery report.
+	if from == nil {
+		switch s.backend.config.MissingFromPolicy {
+		case "reject":
+			logger.Warn("Rejecting message without a From header")
+			return errMissingFrom
+		case "envelope":
+			if s.from != "" {
+				from = &mail.Address{Address: s.from}
+			}
+		}
+		logger.Debug("Message has no From header", "missing_from_policy", s.backend.config.MissingFromPolicy, "using_envelope", from != nil)
+	}
+
+	senderAddr := s.from
+	if resentFrom != nil {
+		senderAddr = resentFrom.Address
+	}
+	mailbox := s.backend.resolveMailbox(senderAddr, logger)
+	if sendFrom != "" {
+		mailbox = s.sendFromMailbox(sendFrom, mailbox)
+	}
+
+	// Never empty: the SMTP layer refuses DATA without RCPT TO
+	to, cc, bcc := assignRecipients(s.to, hdrTo, hdrCc, hdrBcc)
+	msg := &outgoingMessage{
+		To:            to,
+		Cc:            cc,
+		Bcc:           bcc,
+		Subject:       subject,
+		Body:          finalBody,
+		ContentType:   contentType,
+		TextBody:      textAlternative,
+		InReplyTo:     inReplyTo,
+		References:    references,
+		Categories:    categories,
+		Sensitivity:   sensitivity,
+		AutoSubmitted: autoSubmitted,
+		Precedence:    precedence,
+		Headers:       passHeaders,
+		SendAt:        sendAt,
+		Attachments:   attachments,
+		Date:          date,
+		From:          from,
+		FromName:      s.backend.config.FromDisplayName,
+		SendOnBehalf:  s.backend.config.SendOnBehalf,
+		ReplyTo:       replyTo,
+		NullSender:    s.mailReceived && s.from == "",
+	}
+	if msg.Date.IsZero() {
+		msg.Date = time.Now()
+	}
+	if from != nil && from.Name != "" {
+		msg.FromName = from.Name
+	}
+	s.backend.redirectRecipients(msg, logger)
+
+	approval := &presendRequest{
+		From:      s.from,
+		Mailbox:   mailbox,
+		To:        msg.To,
+		Cc:        msg.Cc,
+		Bcc:       msg.Bcc,
+		Subject:   msg.Subject,
+		SizeBytes: len(raw),
+	}
+	if err := s.backend.approveMessage(approval, logger); err != nil {
+		return err
+	}
+	// Only messages that passed every check are archived
+	s.backend.archiveRaw(raw, s.from, s.to, logger)
+
+	if s.backend.config.DeliveryMode == "accept" {
+		id, err := s.backend.queue.Enqueue(mailbox, msg, 0, "", time.Now())
+		if err != nil {
+			logger.Error("Failed to queue message", "error", err)
+			return errQueueUnavailable
+		}
+		logger.Info("Email queued for delivery", "queue_id", id)
+		return nil
+	}
+
+	// Send via Graph API
+	results := s.backend.sendBatches(mailbox, msg)
+	if err = batchesError(results); err != nil {
+		// With the retry queue enabled, accept the message and keep trying
+		// the recipients that failed temporarily; batches already sent
+		// aren't sent again
+		if q := s.backend.queue; q != nil && hasTemporaryFailure(results) {
+			id, qerr := q.EnqueueRemaining(mailbox, msg, results, time.Now())
+			if qerr == nil {
+				logger.Warn("Graph send failed temporarily, queued for retry", "queue_id", id, "error", err)
+				return nil
+			}
+			logger.Error("Failed to queue message for retry", "error", qerr)
+		}
+		if isTokenError(err) {
+			// AAD outages are transient; ask the client to retry
+			logger.Error("Failed to acquire Graph token", "error", err)
+			metrics.Inc("token_errors_total", "Total failures acquiring an Azure AD token.")
+			return errTokenUnavailable
+		}
+		gerr := classifyGraphError(err)
+		logger.Error("Failed to send email via Graph", gerr.logAttrs()...)
+		return gerr.Reply
+	}
+
+	logger.Info("Email sent successfully")
+	return nil
+}
+
+// assignRecipients splits the envelope recipients into To/Cc/Bcc according
+// to the message headers. The envelope decides who gets the message; the
+// headers only decide how each recipient appears. Envelope addresses not in
+// To or Cc were Bcc'd by the client. Without any To/Cc headers, everyone
+// goes in To except addresses listed in a Bcc header, which stay hidden.
+// The Bcc header itself is never passed on to Graph.
+func assignRecipients(envelope []string, hdrTo, hdrCc, hdrBcc []*mail.Address) (to, cc, bcc []string) {
+	envelope = dedupeAddresses(map[string]bool{}, envelope)
+
+	inHeader := func(addrs []*mail.Address, rcpt string) bool {
+		for _, a := range addrs {
+			if strings.EqualFold(a.Address, rcpt) {
+				return true
+			}
+		}
+		return false
+	}
+	noVisibleHeaders := len(hdrTo) == 0 && len(hdrCc) == 0
+	for _, rcpt := range envelope {
+		switch {
+		case inHeader(hdrTo, rcpt):
+			to = append(to, rcpt)
+		case inHeader(hdrCc, rcpt):
+			cc = append(cc, rcpt)
+		case noVisibleHeaders && !inHeader(hdrBcc, rcpt):
+			to = append(to, rcpt)
+		default:
+			bcc = append(bcc, rcpt)
+		}
+	}
+	return to, cc, bcc
+}
+
+var errReadFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to read message data, try again later",
+}
+
+// errIncompleteData answers a DATA transfer that ended before the terminating
+// dot. The client is usually gone by then; the reply is for those that aren't.
+var errIncompleteData = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Incomplete message data, message discarded",
+}
+
+// errQueueUnavailable is returned in accept mode when the message can't be queued.
+var errQueueUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Unable to queue message, try again later",
+}
+
+// errMalformedMessage rejects MIME the parser can't read. It is permanent:
+// resending the same bytes will fail the same way.
+var errMalformedMessage = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Malformed MIME message",
+}
+
+var errEmptyBody = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Message has no body",
+}
+
+var errAttachmentTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Attachment exceeds the maximum attachment size",
+}
+
+var errAttachmentType = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Attachment type not allowed",
+}
+
+// attachmentTooLarge applies max_attachment_bytes (0 = no limit).
+func attachmentTooLarge(config *Config, size int64) bool {
+	return config.MaxAttachmentBytes > 0 && size > config.MaxAttachmentBytes
+}
+
+// attachmentTypeAllowed checks a filename's extension against the blocked
+// and, when non-empty, allowed extension lists. Extensions are compared
+// case-insensitively, with or without the leading dot. Under an allowlist,
+// attachments without an extension are refused.
+func attachmentTypeAllowed(config *Config, filename string) error {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	matches := func(list []string) bool {
+		for _, e := range list {
+			if strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), ".")) == ext {
+				return true
+			}
+		}
+		return false
+	}
+	if ext != "" && matches(config.BlockedAttachmentExtensions) {
+		return fmt.Errorf("extension .%s is blocked", ext)
+	}
+	if len(config.AllowedAttachmentExtensions) > 0 && (ext == "" || !matches(config.AllowedAttachmentExtensions)) {
+		return fmt.Errorf("extension %q is not in allowed_attachment_extensions", ext)
+	}
+	return nil
+}
+
+// forwardedFilename names a message/rfc822 attachment. Forwarded messages
+// often carry no filename; Outlook only opens them with an .eml extension.
+func forwardedFilename(name string, index int) string {
+	if name == "" {
+		if index == 0 {
+			return "forwarded.eml"
+		}
+		return fmt.Sprintf("forwarded-%d.eml", index+1)
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".eml") {
+		name += ".eml"
+	}
+	return name
+}
+
+// parseCategories splits comma-separated X-MS-Categories header values
+// into Outlook category names, dropping blanks and duplicates.
+func parseCategories(values []string) []string {
+	var categories []string
+	for _, v := range values {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			if c != "" && !slices.Contains(categories, c) {
+				categories = append(categories, c)
+			}
+		}
+	}
+	return categories
+}
+
+// addressKey normalizes addr for duplicate detection. Domains are
+// case-insensitive; local parts technically aren't, so they are kept as is.
+func addressKey(addr string) string {
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		return addr[:at] + strings.ToLower(addr[at:])
+	}
+	return addr
+}
+
+// dedupeAddresses drops addresses already in seen (keeping the first
+// occurrence) and records the rest, so sharing seen across To, Cc and Bcc
+// delivers one copy per person.
+func dedupeAddresses(seen map[string]bool, addrs []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		key := addressKey(addr)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, addr)
+	}
+	return out
+}
+
+var errPartTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message part exceeds the maximum part size",
+}
+
+// readPart reads a decoded MIME part, stopping as soon as it exceeds limit
+// bytes (limit <= 0 means no per-part limit). On a read error, such as a
+// part cut off without its closing boundary, it returns what was read.
+func readPart(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return b, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%w (%d bytes)", errPartLimit, limit)
+	}
+	return b, nil
+}
+
+var errPartLimit = errors.New("part exceeds max_part_bytes")
+
+// rejectPart turns a failure reading a MIME part into the SMTP reply: 552
+// for parts over max_part_bytes. For MIME the parser can't read it returns
+// nil under malformed_mime_policy "deliver", so the parts read so far are
+// sent, and 554 under "reject". Parse failures are the client's problem and
+// are counted apart from Graph failures (send_errors_total).
+func (b *Backend) rejectPart(err error, logger *slog.Logger) error {
+	if errors.Is(err, errPartLimit) {
+		logger.Warn("Rejecting message part", "error", err)
+		return errPartTooLarge
+	}
+	metrics.Inc("parse_errors_total", "Total messages whose MIME structure could not be parsed.")
+	if b.config.MalformedMIMEPolicy != "reject" {
+		logger.Warn("Malformed MIME message, delivering the parts read so far", "error", err)
+		return nil
+	}
+	logger.Warn("Rejecting malformed MIME message", "error", err)
+	return errMalformedMessage
+}
+
+var errMultipleFrom = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Multiple From addresses are not supported by Microsoft Graph; send with a single From",
+}
+
+var errMissingFrom = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Message has no From header",
+}
+
+// errTokenUnavailable tells the client to retry when Azure AD can't issue a token.
+var errTokenUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+	Message:      "Temporary failure acquiring Graph token, try again later",
+}
+
+// isTokenError reports whether err came from acquiring an Azure AD token
+// rather than from the Graph send itself.
+func isTokenError(err error) bool {
+	var authErr *azidentity.AuthenticationFailedError
+	return errors.As(err, &authErr)
+}
+
+// rawMessageBody returns everything after the header block, or the whole
+// payload if there is no header/body separator.
+func rawMessageBody(raw []byte) []byte {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(raw, sep); i >= 0 {
+			return raw[i+len(sep):]
+		}
+	}
+	return raw
+}
+
+// cleanSubject folds CR/LF (and other control characters) into spaces so
+// a subject can't smuggle extra headers, and truncates it to
+// max_subject_length characters, which Graph would otherwise reject.
+func (b *Backend) cleanSubject(subject string, logger *slog.Logger) string {
+	clean := strings.Map(func(r rune) rune {
+		if r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return ' '
+	}, subject)
+	if clean != subject {
+		logger.Warn("Stripped control characters from subject")
+	}
+
+	if limit := b.config.MaxSubjectLength; limit > 0 {
+		if runes := []rune(clean); len(runes) > limit {
+			logger.Warn("Subject too long, truncating", "length", len(runes), "max_subject_length", limit)
+			clean = string(runes[:limit])
+		}
+	}
+	return clean
+}
+
+// resolveMailbox picks the Graph mailbox to send as for the given sender.
+// Rewritten senders are routable mailboxes; otherwise the sender's domain
+// may map to a mailbox in sender_mailboxes, and anything else is sent as
+// the configured one.
+func (b *Backend) resolveMailbox(from string, logger *slog.Logger) string {
+	if rewritten, ok := rewriteAddress(b.config.FromRewrite, from); ok {
+		logger.Debug("Rewrote sender address", "original", from, "rewritten", rewritten)
+		return rewritten
+	}
+	if at := strings.LastIndexByte(from, '@'); at >= 0 {
+		if mailbox, ok := b.config.SenderMailboxes[strings.ToLower(from[at+1:])]; ok {
+			logger.Debug("Using sender domain mailbox", "original", from, "using", mailbox)
+			return mailbox
+		}
+	}
+	return b.config.EmailFrom
+}
+
+// sendFromMailbox applies an X-Send-From header: authenticated clients may
+// pick the sending mailbox, if it is in send_from_allowlist. Otherwise the
+// header is ignored and the usual mailbox is kept.
+func (s *Session) sendFromMailbox(header, mailbox string) string {
+	addr, err := netmail.ParseAddress(header)
+	switch {
+	case err != nil:
+		s.logger.Warn("Ignoring unparsable X-Send-From", "from", header, "error", err)
+	case !s.authenticated:
+		s.logger.Warn("Ignoring X-Send-From from unauthenticated client", "from", addr.Address)
+	case !sendFromAllowed(s.backend.config.SendFromAllowlist, addr.Address):
+		s.logger.Warn("Ignoring X-Send-From not in send_from_allowlist", "from", addr.Address)
+	default:
+		s.logger.Debug("Using X-Send-From mailbox", "using", addr.Address, "original", mailbox)
+		return addr.Address
+	}
+	return mailbox
+}
+
+// sendFromAllowed matches addr against send_from_allowlist entries, which
+// are full addresses or "@domain". Matching is case-insensitive.
+func sendFromAllowed(allowlist []string, addr string) bool {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return false
+	}
+	for _, entry := range allowlist {
+		if strings.EqualFold(entry, addr) || strings.EqualFold(entry, addr[at:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteAddress applies from_rewrite rules. Keys are either full addresses
+// ("noreply@internal") or domains ("@internal"); a domain rule replaces only
+// the domain part. Matching is case-insensitive.
+func rewriteAddress(rules map[string]string, addr string) (string, bool) {
+	if len(rules) == 0 || addr == "" {
+		return "", false
+	}
+	lower := strings.ToLower(addr)
+	if to, ok := rules[lower]; ok {
+		return to, true
+	}
+	if at := strings.LastIndexByte(lower, '@'); at >= 0 {
+		if to, ok := rules[lower[at:]]; ok {
+			return addr[:at] + to, true
+		}
+	}
+	return "", false
+}
+
+func (s *Session) Reset() {
+	s.from = ""
+	s.mailReceived = false
+	s.to = nil
+	s.declaredSize = 0
+}
+
+func (s *Session) Logout() error {
+	active := s.backend.untrackSession(s.conn)
+	s.logger.Debug("Session closed", "active_sessions", active)
+	return nil
+}
+
+// outgoingMessage is the parsed SMTP message in the shape we hand to Graph.
+type outgoingMessage struct {
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	Body        string
+	ContentType string // "text" or "html"
+	TextBody    string // text alternative of an HTML body, for html_text_fallback and generate_text_alternative
+	Attachments []outgoingAttachment
+
+	// archive_bcc address, added to the Graph message's Bcc. It is not a
+	// recipient: it doesn't count towards batches or per-recipient results.
+	ArchiveBcc string
+
+	// Threading headers, carried as MAPI properties because Graph only
+	// accepts X- prefixed internetMessageHeaders.
+	InReplyTo  string
+	References string
+
+	// First From header address (nil if absent)
+	From *mail.Address
+
+	// Display name shown for the sending mailbox ("" leaves Graph's default)
+	FromName string
+
+	// Send with the From header address as author and the sending mailbox
+	// as Sender (send_on_behalf)
+	SendOnBehalf bool
+
+	// Reply-To header addresses
+	ReplyTo []string
+
+	// MAIL FROM:<> was given; such messages never get a non-delivery report
+	NullSender bool
+
+	// Outlook categories from X-MS-Categories
+	Categories []string
+
+	// PidTagSensitivity value from the Sensitivity header ("" = not set)
+	Sensitivity string
+
+	// Auto-Submitted and Precedence headers, passed through for auto-responders
+	AutoSubmitted string
+	Precedence    string
+
+	// Client headers passed through as-is (preserve_auth_headers)
+	Headers []messageHeader
+
+	// Deferred delivery requested with X-Send-At (zero = send now)
+	SendAt time.Time
+
+	// Original Date header. Graph always stamps its own sent time, so this
+	// is carried as X-Original-Date for archival workflows.
+	Date time.Time
+}
+
+type outgoingAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// MAPI property tags used for threading (PidTagInReplyToId, PidTagInternetReferences)
+const (
+	propInReplyTo  = "String 0x1042"
+	propReferences = "String 0x1039"
+)
+
+// Graph only accepts X- headers in internetMessageHeaders. Other headers can
+// be set as named properties in the PS_INTERNET_HEADERS namespace, which
+// Exchange writes out as real MIME headers.
+const (
+	propAutoSubmitted = "String {00020386-0000-0000-C000-000000000046} Name Auto-Submitted"
+	propPrecedence    = "String {00020386-0000-0000-C000-000000000046} Name Precedence"
+)
+
+// internetHeaderProp names the PS_INTERNET_HEADERS property for header.
+func internetHeaderProp(header string) string {
+	return "String {00020386-0000-0000-C000-000000000046} Name " + header
+}
+
+type messageHeader struct {
+	Name  string
+	Value string
+}
+
+// authHeaderNames are the authentication results and ARC headers an
+// operator may pass through with preserve_auth_headers.
+var authHeaderNames = []string{
+	"Authentication-Results",
+	"ARC-Authentication-Results",
+	"ARC-Message-Signature",
+	"ARC-Seal",
+	"Received-SPF",
+}
+
+// canonicalAuthHeader validates a preserve_auth_headers entry. The client's
+// DKIM-Signature is always dropped: Exchange Online rewrites the message and
+// signs it with the tenant's own key, so the client's signature would only
+// fail verification downstream.
+func canonicalAuthHeader(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if strings.EqualFold(name, "DKIM-Signature") {
+		return "", fmt.Errorf("PRESERVE_AUTH_HEADERS can't include DKIM-Signature: Exchange Online re-signs relayed mail and the client's signature would no longer verify")
+	}
+	for _, known := range authHeaderNames {
+		if strings.EqualFold(name, known) {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported PRESERVE_AUTH_HEADERS entry %q (expected one of %s)", name, strings.Join(authHeaderNames, ", "))
+}
+
+// managedHeaders are set by the bridge itself or mapped to Graph fields, so
+// forward_headers can't pass the client's copy on as well. Bcc in
+// particular must never reach the delivered message.
+var managedHeaders = []string{
+	"Bcc", "Cc", "To", "From", "Sender", "Resent-Bcc", "Reply-To", "Subject", "Date",
+	"Message-Id", "In-Reply-To", "References", "Return-Path", "Received",
+	"Mime-Version", "Auto-Submitted", "Precedence", "Sensitivity",
+	"Dkim-Signature", "X-Original-Date", "X-Ms-Categories", "X-Send-At",
+	"X-Force-Plain-Text", "X-Send-From", "X-Original-To", "X-Original-Cc",
+	"X-Original-Bcc",
+}
+
+// redirectRecipients applies redirect_all_to: every recipient is replaced
+// by that one address, and the original To/Cc/Bcc are kept in X-Original-*
+// headers so the redirected copy can be checked.
+func (b *Backend) redirectRecipients(msg *outgoingMessage, logger *slog.Logger) {
+	target := b.config.RedirectAllTo
+	if target == "" {
+		return
+	}
+	for _, h := range []struct {
+		name string
+		list []string
+	}{{"X-Original-To", msg.To}, {"X-Original-Cc", msg.Cc}, {"X-Original-Bcc", msg.Bcc}} {
+		if len(h.list) > 0 {
+			msg.Headers = append(msg.Headers, messageHeader{Name: h.name, Value: strings.Join(h.list, ", ")})
+		}
+	}
+	logger.Info("Redirecting message to redirect_all_to", "redirect_all_to", target, "original_recipient_count", len(msg.To)+len(msg.Cc)+len(msg.Bcc))
+	msg.To, msg.Cc, msg.Bcc = []string{target}, nil, nil
+}
+
+// canonicalForwardHeader validates a forward_headers entry and returns its
+// canonical form (e.g. list-unsubscribe becomes List-Unsubscribe).
+func canonicalForwardHeader(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r >= 0x7f || r == ':' }) {
+		return "", fmt.Errorf("FORWARD_HEADERS: invalid header name %q", name)
+	}
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	if strings.HasPrefix(canonical, "Content-") || slices.Contains(managedHeaders, canonical) {
+		return "", fmt.Errorf("FORWARD_HEADERS can't include %s: the bridge sets it from the message itself", name)
+	}
+	for _, auth := range authHeaderNames {
+		if strings.EqualFold(name, auth) {
+			return "", fmt.Errorf("FORWARD_HEADERS can't include %s: use PRESERVE_AUTH_HEADERS", name)
+		}
+	}
+	return canonical, nil
+}
+
+// preservedHeaders collects the named headers present in h. A named
+// property holds one value, so only the topmost (most recent) instance of
+// each header is kept.
+func preservedHeaders(h mail.Header, names []string) []messageHeader {
+	var out []messageHeader
+	for _, name := range names {
+		if value := h.Get(name); value != "" {
+			out = append(out, messageHeader{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+// propDeferredSendTime is PidTagDeferredSendTime: Exchange holds the sent
+// message in the Outbox until then.
+const propDeferredSendTime = "SystemTime 0x3FEF"
+
+// maxSendDelay is how far ahead X-Send-At may schedule a message. Exchange
+// keeps deferred messages in the sending mailbox's Outbox, so far-future
+// sends are refused rather than left there indefinitely.
+const maxSendDelay = 30 * 24 * time.Hour
+
+// parseSendAt parses an X-Send-At header, in RFC 5322 date format (as in the
+// Date header) or RFC 3339. Times up to a minute in the past are taken as
+// "now" to allow for clock skew; those are sent immediately.
+func parseSendAt(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	t, err := netmail.ParseDate(value)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return time.Time{}, fmt.Errorf("not an RFC 5322 or RFC 3339 date")
+		}
+	}
+	switch {
+	case t.Before(now.Add(-time.Minute)):
+		return time.Time{}, fmt.Errorf("time is in the past")
+	case t.After(now.Add(maxSendDelay)):
+		return time.Time{}, fmt.Errorf("time is more than %d days ahead", int(maxSendDelay.Hours()/24))
+	case !t.After(now):
+		return time.Time{}, nil
+	}
+	return t, nil
+}
+
+// propAutoResponseSuppress is PidTagAutoResponseSuppress, sent by Exchange
+// as X-Auto-Response-Suppress.
+const propAutoResponseSuppress = "Integer 0x3FDE"
+
+// headerFlag reads a yes/no control header such as X-Force-Plain-Text.
+func headerFlag(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "yes", "true", "on":
+		return true
+	}
+	return false
+}
+
+// isAutomated reports whether Auto-Submitted (RFC 3834) or Precedence marks
+// a message as automated or bulk mail that shouldn't trigger auto-replies.
+func isAutomated(autoSubmitted, precedence string) bool {
+	if v := strings.ToLower(strings.TrimSpace(autoSubmitted)); v != "" && v != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(precedence)) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return false
+}
+
+// propSensitivity is PidTagSensitivity, which Outlook shows as the
+// Personal/Private/Confidential marking.
+const propSensitivity = "Integer 0x0036"
+
+// sensitivityValues maps Sensitivity header values (RFC 2156, plus the
+// common "Confidential" shorthand) to PidTagSensitivity.
+var sensitivityValues = map[string]string{
+	"normal":               "0",
+	"personal":             "1",
+	"private":              "2",
+	"company-confidential": "3",
+	"confidential":         "3",
+}
+
+// parseSensitivity returns the PidTagSensitivity value for a Sensitivity
+// header, or "" if the header is absent or unrecognized.
+func parseSensitivity(header string) string {
+	return sensitivityValues[strings.ToLower(strings.TrimSpace(header))]
+}
+
+// buildRecipients passes addresses to Graph verbatim. Recipients are never
+// looked up in the directory, so distribution lists and groups are delivered
+// to as a single address and Exchange does the expansion.
+func buildRecipients(addresses []string) []models.Recipientable {
+	recipients := []models.Recipientable{}
+	for _, addr := range addresses {
+		recipient := models.NewRecipient()
+		emailAddr := models.NewEmailAddress()
+		emailAddr.SetAddress(&addr)
+		recipient.SetEmailAddress(emailAddr)
+		recipients = append(recipients, recipient)
+	}
+	return recipients
+}
+
+func buildRecipient(address, name string) models.Recipientable {
+	recipient := models.NewRecipient()
+	emailAddr := models.NewEmailAddress()
+	emailAddr.SetAddress(&address)
+	if name != "" {
+		emailAddr.SetName(&name)
+	}
+	recipient.SetEmailAddress(emailAddr)
+	return recipient
+}
+
+// hasRecipient reports whether addr is already among msg's recipients.
+func hasRecipient(msg *outgoingMessage, addr string) bool {
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, r := range list {
+			if strings.EqualFold(r, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bccRecipients returns msg's Bcc recipients plus its archive_bcc address.
+func bccRecipients(msg *outgoingMessage) []string {
+	if msg.ArchiveBcc != "" && !hasRecipient(msg, msg.ArchiveBcc) {
+		return append(slices.Clip(msg.Bcc), msg.ArchiveBcc)
+	}
+	return msg.Bcc
+}
+
+// buildGraphMessage converts msg into the Graph message sent as mailbox.
+func buildGraphMessage(mailbox string, msg *outgoingMessage) models.Messageable {
+	// Build message
+	message := models.NewMessage()
+	message.SetSubject(&msg.Subject)
+
+	if msg.SendOnBehalf && msg.From != nil && !strings.EqualFold(msg.From.Address, mailbox) {
+		// Outlook shows "<mailbox> on behalf of <author>"
+		message.SetFrom(buildRecipient(msg.From.Address, msg.From.Name))
+		message.SetSender(buildRecipient(mailbox, ""))
+	} else if msg.FromName != "" {
+		message.SetFrom(buildRecipient(mailbox, msg.FromName))
+	}
+
+	messageBody := models.NewItemBody()
+	if msg.ContentType == "html" {
+		bodyType := models.HTML_BODYTYPE
+		messageBody.SetContentType(&bodyType)
+	} else {
+		bodyType := models.TEXT_BODYTYPE
 		messageBody.SetContentType(&bodyType)
 	}
-	messageBody.SetContent(&body)
+	messageBody.SetContent(&msg.Body)
 	message.SetBody(messageBody)
-	message.SetToRecipients(recipients)
+	message.SetToRecipients(buildRecipients(msg.To))
+	if len(msg.Cc) > 0 {
+		message.SetCcRecipients(buildRecipients(msg.Cc))
+	}
+	if bcc := bccRecipients(msg); len(bcc) > 0 {
+		message.SetBccRecipients(buildRecipients(bcc))
+	}
+	if len(msg.ReplyTo) > 0 {
+		message.SetReplyTo(buildRecipients(msg.ReplyTo))
+	}
+	if len(msg.Categories) > 0 {
+		message.SetCategories(msg.Categories)
+	}
+
+	if len(msg.Attachments) > 0 {
+		attachments := make([]models.Attachmentable, 0, len(msg.Attachments))
+		for _, a := range msg.Attachments {
+			attachment := models.NewFileAttachment()
+			attachment.SetName(&a.Name)
+			attachment.SetContentType(&a.ContentType)
+			attachment.SetContentBytes(a.Content)
+			attachments = append(attachments, attachment)
+		}
+		message.SetAttachments(attachments)
+	}
+
+	// X- headers go in internetMessageHeaders; Graph rejects any other
+	// name there, so those become PS_INTERNET_HEADERS properties below
+	var xHeaders []messageHeader
+	if !msg.Date.IsZero() {
+		xHeaders = append(xHeaders, messageHeader{Name: "X-Original-Date", Value: msg.Date.Format(time.RFC1123Z)})
+	}
+	var propHeaders []messageHeader
+	for _, h := range msg.Headers {
+		if len(h.Name) > 2 && strings.EqualFold(h.Name[:2], "X-") {
+			xHeaders = append(xHeaders, h)
+		} else {
+			propHeaders = append(propHeaders, h)
+		}
+	}
+	if len(xHeaders) > 0 {
+		headers := make([]models.InternetMessageHeaderable, 0, len(xHeaders))
+		for _, h := range xHeaders {
+			header := models.NewInternetMessageHeader()
+			header.SetName(&h.Name)
+			header.SetValue(&h.Value)
+			headers = append(headers, header)
+		}
+		message.SetInternetMessageHeaders(headers)
+	}
+
+	// Thread replies into the existing conversation, and mark automated
+	// mail so auto-responders leave it alone
+	autoResponseSuppress := ""
+	if isAutomated(msg.AutoSubmitted, msg.Precedence) {
+		autoResponseSuppress = "-1" // suppress all auto-replies, OOF and receipts
+	}
+	var props []models.SingleValueLegacyExtendedPropertyable
+	for _, p := range [][2]string{
+		{propInReplyTo, msg.InReplyTo},
+		{propReferences, msg.References},
+		{propSensitivity, msg.Sensitivity},
+		{propAutoSubmitted, msg.AutoSubmitted},
+		{propPrecedence, msg.Precedence},
+		{propAutoResponseSuppress, autoResponseSuppress},
+	} {
+		props = appendProp(props, p[0], p[1])
+	}
+	for _, h := range propHeaders {
+		props = appendProp(props, internetHeaderProp(h.Name), h.Value)
+	}
+	if !msg.SendAt.IsZero() {
+		props = appendProp(props, propDeferredSendTime, msg.SendAt.UTC().Format(time.RFC3339))
+	}
+	if len(props) > 0 {
+		message.SetSingleValueExtendedProperties(props)
+	}
+
+	return message
+}
+
+// appendProp adds a single-value extended property unless value is empty.
+func appendProp(props []models.SingleValueLegacyExtendedPropertyable, id, value string) []models.SingleValueLegacyExtendedPropertyable {
+	if value == "" {
+		return props
+	}
+	prop := models.NewSingleValueLegacyExtendedProperty()
+	prop.SetId(&id)
+	prop.SetValue(&value)
+	return append(props, prop)
+}
+
+func (b *Backend) sendViaGraph(mailbox string, msg *outgoingMessage) error {
+	return batchesError(b.sendBatches(mailbox, msg))
+}
+
+// batchesError combines batch results into one error, nil if every batch
+// was sent.
+func batchesError(results []batchResult) error {
+	if len(results) == 1 {
+		return results[0].Err
+	}
+
+	// The first error is reported
+	var firstErr error
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = r.Err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d recipient batches failed: %w", failed, len(results), firstErr)
+	}
+	return nil
+}
+
+// batchResult is the outcome of one Graph send of a recipient batch.
+type batchResult struct {
+	Batch *outgoingMessage
+	Err   error
+}
+
+// sendBatches sends msg in recipient_batch_size chunks. Every batch is sent
+// even if one fails, so a bad recipient doesn't hold up the others.
+func (b *Backend) sendBatches(mailbox string, msg *outgoingMessage) []batchResult {
+	// Settings are applied to a copy: the caller's message may be queued and
+	// sent again, and should pick up the configuration in force then
+	send := *msg
+	msg = &send
+
+	// Route replies and bounces centrally unless the client chose a Reply-To
+	if len(msg.ReplyTo) == 0 && b.config.DefaultReplyTo != "" {
+		msg.ReplyTo = []string{b.config.DefaultReplyTo}
+	}
+	// Every Graph send is archived, so a batched message reaches the
+	// archive once per batch
+	msg.ArchiveBcc = b.config.ArchiveBcc
+
+	batches := splitRecipients(msg, b.config.RecipientBatchSize)
+	if len(batches) == 1 {
+		return []batchResult{{Batch: msg, Err: b.sendGraphMessage(mailbox, msg)}}
+	}
+
+	results := make([]batchResult, 0, len(batches))
+	for i, batch := range batches {
+		count := len(batch.To) + len(batch.Cc) + len(batch.Bcc)
+		err := b.sendGraphMessage(mailbox, batch)
+		if err != nil {
+			b.logger.Warn("Recipient batch failed", "batch", i+1, "batches", len(batches), "recipient_count", count, "error", err)
+		} else {
+			b.logger.Debug("Recipient batch sent", "batch", i+1, "batches", len(batches), "recipient_count", count)
+		}
+		results = append(results, batchResult{Batch: batch, Err: err})
+	}
+	return results
+}
+
+// splitRecipients chunks msg into copies with at most size recipients each,
+// keeping every recipient's To/Cc/Bcc role. size <= 0 disables batching.
+func splitRecipients(msg *outgoingMessage, size int) []*outgoingMessage {
+	if size <= 0 || len(msg.To)+len(msg.Cc)+len(msg.Bcc) <= size {
+		return []*outgoingMessage{msg}
+	}
+
+	var batches []*outgoingMessage
+	var current *outgoingMessage
+	add := func(list func(*outgoingMessage) *[]string, addr string) {
+		if current == nil || len(current.To)+len(current.Cc)+len(current.Bcc) == size {
+			batch := *msg
+			batch.To, batch.Cc, batch.Bcc = nil, nil, nil
+			current = &batch
+			batches = append(batches, current)
+		}
+		*list(current) = append(*list(current), addr)
+	}
+	for _, addr := range msg.To {
+		add(func(m *outgoingMessage) *[]string { return &m.To }, addr)
+	}
+	for _, addr := range msg.Cc {
+		add(func(m *outgoingMessage) *[]string { return &m.Cc }, addr)
+	}
+	for _, addr := range msg.Bcc {
+		add(func(m *outgoingMessage) *[]string { return &m.Bcc }, addr)
+	}
+	return batches
+}
+
+// sendGraphMessage sends msg as mailbox. If Graph reports the mailbox itself
+// as unusable, the send is retried once through fallback_email_from.
+func (b *Backend) sendGraphMessage(mailbox string, msg *outgoingMessage) error {
+	err := b.postSendMail(mailbox, msg)
+	if err != nil && msg.ContentType == "html" && b.config.HTMLTextFallback && isBodyRejection(err, msg) {
+		msg = textFallback(msg)
+		b.logger.Warn("Graph rejected the HTML body, resending as plain text", "mailbox", mailbox, "error", err)
+		metrics.Inc("html_text_fallbacks_total", "Total messages resent as plain text after Graph rejected the HTML body.")
+		err = b.postSendMail(mailbox, msg)
+	}
+	fallback := b.config.FallbackEmailFrom
+	if err == nil || fallback == "" || strings.EqualFold(fallback, mailbox) || !isMailboxUnavailable(err) {
+		return err
+	}
+
+	b.logger.Warn("Sender mailbox unavailable, sending through fallback mailbox", "mailbox", mailbox, "fallback", fallback, "error", err)
+	metrics.Inc("fallback_sends_total", "Total messages re-sent through fallback_email_from.")
+	if ferr := b.postSendMail(fallback, msg); ferr != nil {
+		return fmt.Errorf("fallback mailbox %s also failed: %w", fallback, ferr)
+	}
+	return nil
+}
+
+// textFallback returns a copy of msg with its HTML body replaced by the text
+// alternative, or by a conversion of the HTML when the message had none.
+func textFallback(msg *outgoingMessage) *outgoingMessage {
+	text := *msg
+	text.Body = msg.TextBody
+	if strings.TrimSpace(text.Body) == "" {
+		text.Body = htmlToText(msg.Body)
+	}
+	text.ContentType = "text"
+	text.TextBody = ""
+	return &text
+}
+
+// postSendMail makes one Graph sendMail attempt as mailbox. Each attempt
+// takes a daily_send_limit slot (given back if the send fails), waits for
+// its mailbox_send_rate slot, and is let through and recorded by the circuit
+// breaker. Retries such as the fallback_email_from resend call it again and
+// are charged again.
+func (b *Backend) postSendMail(mailbox string, msg *outgoingMessage) error {
+	if err := b.quota.take(mailbox, time.Now()); err != nil {
+		return err
+	}
+	// Paced before the breaker is asked, so a half-open probe slot is only
+	// taken by a send that goes ahead
+	if err := b.pacer.wait(mailbox); err != nil {
+		b.quota.release(mailbox, time.Now())
+		return err
+	}
+	if err := b.breaker.allow(time.Now()); err != nil {
+		b.quota.release(mailbox, time.Now())
+		return err
+	}
 
-	// Send email
-	requestBody := users.NewItemSendMailPostRequestBody()
-	requestBody.SetMessage(message)
-	saveToSentItems := true
-	requestBody.SetSaveToSentItems(&saveToSentItems)
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.GraphTimeout)
+	defer cancel()
 
-	err := s.backend.graphClient.Users().
-		ByUserId(s.backend.config.EmailFrom).
-		SendMail().
-		Post(ctx, requestBody, nil)
+	err := b.send(ctx, mailbox, msg)
+	b.breaker.record(err, time.Now())
+	if err != nil {
+		b.quota.release(mailbox, time.Now())
+		metrics.Inc("send_errors_total", "Total Graph sendMail calls that failed.")
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("graph request timed out after %s: %w", b.config.GraphTimeout, err)
+	}
 
 	return err
 }
 
-func startHealthServer(port string, logger *slog.Logger) {
+// send makes the Graph sendMail call: as MIME when the message gets a text
+// alternative and the sender supports it, otherwise as a Graph message.
+func (b *Backend) send(ctx context.Context, mailbox string, msg *outgoingMessage) error {
+	if ms, ok := b.sender.(MIMESender); ok && useMIME(b.config, msg) {
+		raw, err := buildMIMEMessage(mailbox, msg)
+		if err != nil {
+			return fmt.Errorf("failed to build MIME message: %w", err)
+		}
+		return ms.SendMIME(ctx, mailbox, raw)
+	}
+	return b.sender.Send(ctx, mailbox, buildGraphMessage(mailbox, msg))
+}
+
+// reservedHTTPPaths are served by the health server regardless of config.
+var reservedHTTPPaths = []string{"/metrics", "/version", "/api/send", "/admin/maintenance", "/queue"}
+
+// validateProbePaths checks health_path and ready_path before they are
+// registered, since the mux panics on duplicate or malformed patterns.
+func validateProbePaths(health, ready string) error {
+	for _, p := range []struct{ name, path string }{{"HEALTH_PATH", health}, {"READY_PATH", ready}} {
+		if p.path == "" && p.name == "READY_PATH" {
+			continue
+		}
+		if !strings.HasPrefix(p.path, "/") || strings.ContainsAny(p.path, " {}") {
+			return fmt.Errorf("%s must be a URL path starting with /, got %q", p.name, p.path)
+		}
+		if slices.Contains(reservedHTTPPaths, p.path) {
+			return fmt.Errorf("%s %s is already used by the health server", p.name, p.path)
+		}
+	}
+	if health == ready {
+		return fmt.Errorf("HEALTH_PATH and READY_PATH must differ")
+	}
+	return nil
+}
+
+// newHealthMux routes health, readiness, metrics, version and (with an
+// API key) the HTTP API.
+func newHealthMux(b *Backend) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "OK")
+	mux.HandleFunc(b.config.HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("deep") != "true" {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "OK")
+			return
+		}
+		b.checkGraphToken(w, r)
 	})
+	if b.config.ReadyPath != "" {
+		// Ready means able to take mail: not in maintenance and Graph reachable
+		mux.HandleFunc(b.config.ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+			if b.maintenance.Load() {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(map[string]string{"status": "maintenance"})
+				return
+			}
+			b.checkGraphToken(w, r)
+		})
+	}
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/version", handleVersion)
+
+	if b.config.APIKey != "" {
+		registerAPIRoutes(mux, b)
+		b.logger.Info("HTTP send API enabled", "path", "/api/send")
+	}
+	return mux
+}
+
+// checkGraphToken answers a deep health check: it makes sure we can still
+// acquire a Graph token, which catches expired certificates. The endpoint
+// is unauthenticated, so the Azure AD error, which names the tenant and
+// app, is only logged.
+func (b *Backend) checkGraphToken(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := b.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{graphScope(b.config)}}); err != nil {
+		b.logger.Warn("Deep health check failed", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "error": "token acquisition failed"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// startHealthServer serves health, metrics and the API, over HTTPS when
+// tlsConfig is non-nil.
+func startHealthServer(b *Backend, tlsConfig *tls.Config) {
+	port, logger := b.config.HealthPort, b.logger
+	mux := newHealthMux(b)
 
 	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:      ":" + port,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 
-	logger.Info("Health server starting", "port", port)
-	if err := server.ListenAndServe(); err != nil {
+	logger.Info("Health server starting", "port", port, "tls", tlsConfig != nil)
+	var err error
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		logger.Error("Health server failed", "error", err)
 	}
 }
 
+// runCheck verifies that a Graph token can be acquired and, if sendTo is
+// set, that a test message can be sent. Config and certificate problems
+// have already failed by the time this runs.
+func runCheck(b *Backend, sendTo string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenWarmupTimeout)
+	defer cancel()
+	if _, err := b.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{graphScope(b.config)}}); err != nil {
+		return fmt.Errorf("failed to acquire Graph token: %w", err)
+	}
+	b.logger.Info("Graph token acquired")
+
+	if sendTo == "" {
+		return nil
+	}
+	return b.sendSelfTest(sendTo, "This is a test message sent by smtp-graph-bridge --check.")
+}
+
+// verifyMailboxes looks up the sending mailboxes in Graph (verify_mailbox).
+// A missing or disabled mailbox is logged, and exits under "fail". Lacking
+// permission to read users is only a warning, whatever the policy.
+func (b *Backend) verifyMailboxes(g *graphSender) {
+	for _, mailbox := range b.sendingMailboxes() {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenWarmupTimeout)
+		err := g.verifyMailbox(ctx, mailbox)
+		cancel()
+		switch {
+		case err == nil:
+			b.logger.Info("Sending mailbox verified", "mailbox", mailbox)
+		case errors.Is(err, errMailboxLookupDenied):
+			b.logger.Warn("Skipping mailbox verification", "mailbox", mailbox, "error", err)
+			return
+		case b.config.VerifyMailbox == "fail":
+			b.logger.Error("Sending mailbox verification failed", "mailbox", mailbox, "error", err)
+			os.Exit(1)
+		default:
+			b.logger.Warn("Sending mailbox verification failed, sends as this mailbox will fail", "mailbox", mailbox, "error", err)
+		}
+	}
+}
+
+// sendingMailboxes lists every mailbox the config can send as:
+// ms_graph_email_from, fallback_email_from and the sender_mailboxes targets.
+func (b *Backend) sendingMailboxes() []string {
+	mailboxes := []string{b.config.EmailFrom}
+	if b.config.FallbackEmailFrom != "" {
+		mailboxes = append(mailboxes, b.config.FallbackEmailFrom)
+	}
+	var targets []string
+	for _, mailbox := range b.config.SenderMailboxes {
+		targets = append(targets, mailbox)
+	}
+	slices.Sort(targets)
+	for _, mailbox := range targets {
+		if !slices.ContainsFunc(mailboxes, func(m string) bool { return strings.EqualFold(m, mailbox) }) {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	return mailboxes
+}
+
+// sendSelfTest sends a short message from the default mailbox to the given
+// address through the normal Graph path.
+func (b *Backend) sendSelfTest(to, body string) error {
+	msg := &outgoingMessage{
+		To:          []string{to},
+		Subject:     "smtp-graph-bridge configuration check",
+		Body:        body,
+		ContentType: "text",
+		Date:        time.Now(),
+	}
+	if err := b.sendViaGraph(b.config.EmailFrom, msg); err != nil {
+		return fmt.Errorf("failed to send test message: %w", classifyGraphError(err))
+	}
+	b.logger.Info("Test message sent", "to", to)
+	return nil
+}
+
+// startupSelfTest sends the startup_test_recipient test message, if one is
+// configured. A failure is logged; it is only returned, to abort startup,
+// with startup_test_fail.
+func (b *Backend) startupSelfTest() error {
+	to := b.config.StartupTestRecipient
+	if to == "" {
+		return nil
+	}
+	err := b.sendSelfTest(to, "This is a startup test message sent by smtp-graph-bridge.")
+	if err == nil {
+		return nil
+	}
+	b.logger.Error("STARTUP SELF-TEST FAILED: the bridge cannot send through Graph", "error", err)
+	if b.config.StartupTestFail {
+		return err
+	}
+	return nil
+}
+
+// newSMTPServer returns the SMTP server for b with the protocol settings
+// shared by production and tests. The caller sets Addr and serves it.
+func newSMTPServer(b *Backend) *smtp.Server {
+	server := smtp.NewServer(b)
+	server.Domain = "localhost"
+	// go-smtp applies ReadTimeout while waiting for each command line and
+	// answers 421 4.4.2 when it expires, which makes it the idle timeout.
+	// DATA is covered separately by dataReadTimeout.
+	server.ReadTimeout = b.config.IdleTimeout
+	if server.ReadTimeout <= 0 {
+		server.ReadTimeout = defaultIdleTimeout
+	}
+	server.WriteTimeout = 30 * time.Second
+	server.MaxMessageBytes = b.config.MaxMessageBytes
+	server.MaxRecipients = 50
+	server.AllowInsecureAuth = b.config.AllowInsecureAuth
+	server.TLSConfig = b.tlsConfig
+	// Addresses are passed through to Graph verbatim, so UTF-8 local parts
+	// and domains (RFC 6531) need no special handling
+	server.EnableSMTPUTF8 = true
+	// go-smtp always advertises 8BITMIME; Data reads bodies as raw bytes, so
+	// 8-bit UTF-8 content reaches Graph unchanged
+	return server
+}
+
 func main() {
+	configPath := flag.String("config", "", "path to a config file (.yaml or .json; default: search ./config.{yaml,json} and /etc/smtp-graph-bridge/config.{yaml,json})")
+	check := flag.Bool("check", false, "validate config, certificate and Graph token, then exit without starting the server")
+	checkSendTo := flag.String("check-send-to", "", "with --check, also send a test message to this address")
+	flag.Parse()
+
 	// Initial logger (will be updated after config load if needed)
-	logger := initLogger("info")
-	logger.Info("Starting SMTP-Graph Bridge", "version", "0.1.0")
+	logger, _ := initLogger("info", "json", "stdout", false)
+	info := currentBuildInfo()
+	logger.Info("Starting SMTP-Graph Bridge", "version", info.Version, "commit", info.Commit, "build_date", info.BuildDate, "go_version", info.GoVersion)
 
 	// Load configuration
-	config, err := loadConfig()
+	config, err := loadConfig(*configPath)
 	if err != nil {
 		logger.Error("Configuration error", "error", err)
 		os.Exit(1)
 	}
 
 	// Re-init logger with configured level
-	logger = initLogger(config.LogLevel)
-	logger.Info("Configuration loaded", 
-		"tenant_id", config.TenantID[:8]+"...", 
-		"email_from", config.EmailFrom,
-		"smtp_port", config.SMTPPort,
-	)
+	logger, err = initLogger(config.LogLevel, config.LogFormat, config.LogOutput, config.LogRedact)
+	if err != nil {
+		slog.Error("Logging configuration error", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Configuration loaded", configLogAttr(config))
 
 	// Initialize Graph client
-	graphClient, err := initGraphClient(config, logger)
+	graphClient, cred, err := initGraphClient(config, logger)
+	if errors.Is(err, errCertPassword) {
+		logger.Error("Certificate password incorrect, check MS_GRAPH_CERT_PASS against the mounted certificate", "error", err)
+		os.Exit(1)
+	}
 	if err != nil {
 		logger.Error("Failed to initialize Graph client", "error", err)
 		os.Exit(1)
 	}
 
-	// Start Health Check Server
-	go startHealthServer(config.HealthPort, logger)
-
-	// Create SMTP backend
+	// Create SMTP backend (CIDRs were validated by loadConfig)
+	trustedProxies, _ := parseCIDRs(config.TrustedProxyCIDRs)
+	quota, err := newSendQuota(config.DailySendLimit, config.DailySendLimitFile, logger)
+	if err != nil {
+		logger.Error("Failed to load daily send counts", "error", err)
+		os.Exit(1)
+	}
 	backend := &Backend{
-		config:      config,
-		graphClient: graphClient,
-		logger:      logger,
+		config:         config,
+		sender:         &graphSender{client: graphClient},
+		credential:     cred,
+		logger:         logger,
+		budget:         newMemoryBudget(config.MaxInflightBytes),
+		pacer:          newSendPacer(config.MailboxSendRate),
+		breaker:        newCircuitBreaker(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown, logger),
+		quota:          quota,
+		trustedProxies: trustedProxies,
 	}
 
-	// Create SMTP server
-	server := smtp.NewServer(backend)
-	server.Addr = fmt.Sprintf("%s:%s", config.SMTPHost, config.SMTPPort)
-	server.Domain = "localhost"
-	server.ReadTimeout = 30 * time.Second
-	server.WriteTimeout = 30 * time.Second
-	server.MaxMessageBytes = 10 * 1024 * 1024 // 10MB
-	server.MaxRecipients = 50
-	server.AllowInsecureAuth = true
-	
-	// We don't need to log this via Printf anymore, the logger handles it structured
-	if config.RequireAuth {
-		logger.Info("SMTP authentication enabled")
-	} else {
-		logger.Info("SMTP authentication disabled")
+	if config.VerifyMailbox != "off" {
+		backend.verifyMailboxes(backend.sender.(*graphSender))
+	}
+
+	if *check {
+		if err := runCheck(backend, *checkSendTo); err != nil {
+			logger.Error("Check failed", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Check passed")
+		return
+	}
+
+	if err := backend.startupSelfTest(); err != nil {
+		os.Exit(1)
+	}
+
+	if config.RedirectAllTo != "" {
+		logger.Warn("redirect_all_to is set, every message is delivered to it instead of its recipients", "redirect_all_to", config.RedirectAllTo)
+	}
+
+	if config.QueueDir != "" || config.DeliveryMode == "accept" {
+		backend.queue, err = newRetryQueue(config, backend)
+		if err != nil {
+			logger.Error("Failed to initialize retry queue", "error", err)
+			os.Exit(1)
+		}
+		if config.QueueDir == "" {
+			logger.Warn("Accept mode without queue_dir: queued messages are lost on restart")
+		}
+		logger.Info("Retry queue enabled", "delivery_mode", config.DeliveryMode, "queue_dir", config.QueueDir, "max_retries", config.QueueMaxRetries)
+		go backend.queue.Run(context.Background())
 	}
 
-	logger.Info("SMTP server listening", "address", server.Addr)
+	// SIGUSR1 toggles maintenance mode
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			backend.setMaintenance(!backend.maintenance.Load())
+		}
+	}()
+
+	// Start Health Check Server
+	healthTLS, err := buildHealthTLSConfig(config)
+	if err != nil {
+		logger.Error("Health server TLS configuration error", "error", err)
+		os.Exit(1)
+	}
+	go startHealthServer(backend, healthTLS)
 
-	if err := server.ListenAndServe(); err != nil {
-		logger.Error("SMTP server error", "error", err)
+	backend.tlsConfig, err = buildTLSConfig(config)
+	if err != nil {
+		logger.Error("TLS configuration error", "error", err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+	if backend.tlsConfig != nil {
+		logger.Info("STARTTLS enabled", "min_version", config.TLSMinVersion)
+	}
+
+	// Start one SMTP server per listener, all sharing the backend
+	listeners := smtpListeners(config)
+	if config.MaxConnections > 0 {
+		logger.Info("SMTP connection limit enabled", "max_connections", config.MaxConnections)
+	}
+	if config.MaxSessionsPerIP > 0 {
+		logger.Info("Per-client session limit enabled", "max_sessions_per_ip", config.MaxSessionsPerIP)
+	}
+	if config.ProxyProtocol {
+		logger.Info("PROXY protocol enabled, expecting header on every connection")
+	}
+	if config.GreetingDelay > 0 {
+		logger.Info("SMTP greeting delay enabled", "delay", config.GreetingDelay)
+	}
+	serveErrs := make(chan error, len(listeners))
+	var servers []*smtp.Server
+	for _, l := range listeners {
+		ln, err := listenSMTP(backend, l, logger)
+		if err != nil {
+			logger.Error("SMTP server error", "address", l.Address, "error", err)
+			os.Exit(1)
+		}
+		server := newListenerServer(backend, l)
+		servers = append(servers, server)
+		go func() { serveErrs <- server.Serve(ln) }()
+	}
+
+	// SIGINT/SIGTERM stop accepting connections, let open sessions finish
+	// and wait for background sends, up to shutdownTimeout
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErrs:
+		if err != nil {
+			logger.Error("SMTP server error", "error", err)
+			os.Exit(1)
+		}
+	case sig := <-stop:
+		logger.Info("Shutting down", "signal", sig.String(), "timeout", shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("SMTP sessions still open at shutdown", "error", err)
+			}
+		}
+		if err := backend.waitBackground(ctx); err != nil {
+			logger.Warn("Background sends still running at shutdown", "error", err)
+		}
+		logger.Info("Shutdown complete")
+	}
+}
+
+// shutdownTimeout bounds how long shutdown waits for open sessions and
+// background sends.
+const shutdownTimeout = 30 * time.Second
+
+// waitBackground waits for background sends to finish, or for ctx.
+func (b *Backend) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
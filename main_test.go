@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestRewriteAddress(t *testing.T) {
+	rules := map[string]string{
+		"noreply@internal": "noreply@contoso.com",
+		"@legacy.local":    "@contoso.com",
+	}
+
+	got, ok := rewriteAddress(rules, "NoReply@Internal")
+	assert.True(t, ok)
+	assert.Equal(t, "noreply@contoso.com", got)
+
+	got, ok = rewriteAddress(rules, "alerts@legacy.local")
+	assert.True(t, ok)
+	assert.Equal(t, "alerts@contoso.com", got)
+
+	_, ok = rewriteAddress(rules, "someone@example.com")
+	assert.False(t, ok)
+}
+
+func TestResolveMailbox_SenderDomain(t *testing.T) {
+	b := newTestBackend(&Config{
+		EmailFrom:       "bridge@example.com",
+		FromRewrite:     map[string]string{"noreply@branda.com": "noreply@contoso.com"},
+		SenderMailboxes: map[string]string{"branda.com": "shared-a@contoso.com", "brandb.com": "shared-b@contoso.com"},
+	})
+
+	assert.Equal(t, "shared-a@contoso.com", b.resolveMailbox("alerts@brandA.com", b.logger))
+	assert.Equal(t, "shared-b@contoso.com", b.resolveMailbox("alerts@brandb.com", b.logger))
+	assert.Equal(t, "noreply@contoso.com", b.resolveMailbox("noreply@branda.com", b.logger), "from_rewrite wins")
+	assert.Equal(t, "bridge@example.com", b.resolveMailbox("alerts@other.com", b.logger))
+}
+
+func TestRecipientDomainAllowed(t *testing.T) {
+	config := &Config{}
+	assert.True(t, recipientDomainAllowed(config, "user@anywhere.com"))
+
+	config.BlockedRecipientDomains = []string{"customer.com"}
+	assert.False(t, recipientDomainAllowed(config, "user@Customer.com"))
+	assert.True(t, recipientDomainAllowed(config, "user@contoso.com"))
+
+	config.AllowedRecipientDomains = []string{"contoso.com"}
+	assert.True(t, recipientDomainAllowed(config, "user@contoso.com"))
+	assert.False(t, recipientDomainAllowed(config, "user@example.com"))
+}
+
+func TestBuildGraphMessage_Threading(t *testing.T) {
+	message := buildGraphMessage("bridge@example.com", &outgoingMessage{
+		To:         []string{"user@example.com"},
+		Subject:    "Re: Ticket 42",
+		Body:       "hello",
+		InReplyTo:  "<abc@example.com>",
+		References: "<root@example.com> <abc@example.com>",
+	})
+
+	props := message.GetSingleValueExtendedProperties()
+	if assert.Len(t, props, 2) {
+		assert.Equal(t, propInReplyTo, *props[0].GetId())
+		assert.Equal(t, "<abc@example.com>", *props[0].GetValue())
+		assert.Equal(t, propReferences, *props[1].GetId())
+	}
+}
+
+func TestAssignRecipients(t *testing.T) {
+	addrs := func(list ...string) []*mail.Address {
+		var out []*mail.Address
+		for _, a := range list {
+			out = append(out, &mail.Address{Address: a})
+		}
+		return out
+	}
+
+	// Headers decide placement; envelope-only addresses become Bcc
+	to, cc, bcc := assignRecipients(
+		[]string{"a@example.com", "B@example.com", "hidden@example.com"},
+		addrs("a@example.com"), addrs("b@example.com", "not-delivered@example.com"), nil,
+	)
+	assert.Equal(t, []string{"a@example.com"}, to)
+	assert.Equal(t, []string{"B@example.com"}, cc)
+	assert.Equal(t, []string{"hidden@example.com"}, bcc)
+
+	// No recipient headers: fall back to the envelope as To
+	to, cc, bcc = assignRecipients([]string{"a@example.com", "b@example.com"}, nil, nil, nil)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+	assert.Empty(t, cc)
+	assert.Empty(t, bcc)
+
+	// ...except recipients named in a Bcc header, which stay hidden
+	to, cc, bcc = assignRecipients([]string{"a@example.com", "b@example.com"}, nil, nil, addrs("b@example.com"))
+	assert.Equal(t, []string{"a@example.com"}, to)
+	assert.Empty(t, cc)
+	assert.Equal(t, []string{"b@example.com"}, bcc)
+}
+
+func TestCleanSubject(t *testing.T) {
+	b := newTestBackend(&Config{MaxSubjectLength: 10})
+
+	assert.Equal(t, "Hi  Bcc: x", b.cleanSubject("Hi\r\nBcc: x", b.logger))
+	assert.Equal(t, "Grüße aus ", b.cleanSubject("Grüße aus München", b.logger))
+
+	b.config.MaxSubjectLength = 0
+	assert.Equal(t, "a\tb", b.cleanSubject("a\tb", b.logger))
+}
+
+func TestBuildGraphMessage_FromName(t *testing.T) {
+	message := buildGraphMessage("support@contoso.com", &outgoingMessage{FromName: "Support Team"})
+	addr := message.GetFrom().GetEmailAddress()
+	assert.Equal(t, "support@contoso.com", *addr.GetAddress())
+	assert.Equal(t, "Support Team", *addr.GetName())
+
+	assert.Nil(t, buildGraphMessage("support@contoso.com", &outgoingMessage{}).GetFrom())
+}
+
+func TestBuildGraphMessage_ReplyTo(t *testing.T) {
+	message := buildGraphMessage("bridge@example.com", &outgoingMessage{ReplyTo: []string{"bounces@contoso.com"}})
+	require.Len(t, message.GetReplyTo(), 1)
+	assert.Equal(t, "bounces@contoso.com", *message.GetReplyTo()[0].GetEmailAddress().GetAddress())
+}
+
+func TestBuildGraphMessage_Categories(t *testing.T) {
+	categories := parseCategories([]string{"Invoice, Urgent", " ,Invoice", "Finance"})
+	assert.Equal(t, []string{"Invoice", "Urgent", "Finance"}, categories)
+
+	message := buildGraphMessage("bridge@example.com", &outgoingMessage{Categories: categories})
+	assert.Equal(t, categories, message.GetCategories())
+}
+
+func TestBuildGraphMessage_Sensitivity(t *testing.T) {
+	assert.Equal(t, "3", parseSensitivity("Company-Confidential"))
+	assert.Equal(t, "3", parseSensitivity(" confidential"))
+	assert.Equal(t, "2", parseSensitivity("Private"))
+	assert.Equal(t, "", parseSensitivity("top secret"))
+
+	message := buildGraphMessage("bridge@example.com", &outgoingMessage{Sensitivity: "2"})
+	props := message.GetSingleValueExtendedProperties()
+	require.Len(t, props, 1)
+	assert.Equal(t, propSensitivity, *props[0].GetId())
+	assert.Equal(t, "2", *props[0].GetValue())
+}
+
+func TestBuildGraphMessage_AutoSubmitted(t *testing.T) {
+	props := func(msg *outgoingMessage) map[string]string {
+		out := map[string]string{}
+		for _, p := range buildGraphMessage("bridge@example.com", msg).GetSingleValueExtendedProperties() {
+			out[*p.GetId()] = *p.GetValue()
+		}
+		return out
+	}
+
+	got := props(&outgoingMessage{AutoSubmitted: "auto-generated"})
+	assert.Equal(t, "auto-generated", got[propAutoSubmitted])
+	assert.Equal(t, "-1", got[propAutoResponseSuppress])
+
+	got = props(&outgoingMessage{Precedence: "Bulk"})
+	assert.Equal(t, "Bulk", got[propPrecedence])
+	assert.Equal(t, "-1", got[propAutoResponseSuppress])
+
+	got = props(&outgoingMessage{AutoSubmitted: "no"})
+	assert.NotContains(t, got, propAutoResponseSuppress)
+}
+
+func TestBuildGraphMessage_SendOnBehalf(t *testing.T) {
+	msg := &outgoingMessage{
+		From:         &mail.Address{Name: "Jane Client", Address: "jane@customer.example"},
+		FromName:     "Jane Client",
+		SendOnBehalf: true,
+	}
+	message := buildGraphMessage("service@contoso.com", msg)
+	assert.Equal(t, "jane@customer.example", *message.GetFrom().GetEmailAddress().GetAddress())
+	assert.Equal(t, "Jane Client", *message.GetFrom().GetEmailAddress().GetName())
+	assert.Equal(t, "service@contoso.com", *message.GetSender().GetEmailAddress().GetAddress())
+
+	// Author is the mailbox itself: a plain send
+	msg.From.Address = "Service@contoso.com"
+	message = buildGraphMessage("service@contoso.com", msg)
+	assert.Equal(t, "service@contoso.com", *message.GetFrom().GetEmailAddress().GetAddress())
+	assert.Nil(t, message.GetSender())
+
+	// Disabled: From stays the mailbox
+	msg.From.Address, msg.SendOnBehalf = "jane@customer.example", false
+	message = buildGraphMessage("service@contoso.com", msg)
+	assert.Equal(t, "service@contoso.com", *message.GetFrom().GetEmailAddress().GetAddress())
+	assert.Nil(t, message.GetSender())
+}
+
+func TestAssignRecipients_Dedupe(t *testing.T) {
+	// Listed in both To and Cc, and RCPT'd twice with a differently-cased domain
+	to, cc, bcc := assignRecipients(
+		[]string{"a@example.com", "a@EXAMPLE.com", "b@example.com"},
+		[]*mail.Address{{Address: "a@example.com"}},
+		[]*mail.Address{{Address: "a@example.com"}, {Address: "b@example.com"}},
+		nil,
+	)
+	assert.Equal(t, []string{"a@example.com"}, to)
+	assert.Equal(t, []string{"b@example.com"}, cc)
+	assert.Empty(t, bcc)
+
+	seen := map[string]bool{}
+	assert.Equal(t, []string{"x@example.com"}, dedupeAddresses(seen, []string{"x@example.com", "x@Example.COM"}))
+	assert.Empty(t, dedupeAddresses(seen, []string{"x@example.com"}))
+}
+
+func TestSplitRecipients(t *testing.T) {
+	msg := &outgoingMessage{
+		Subject: "hi",
+		To:      []string{"t1@x.com", "t2@x.com", "t3@x.com"},
+		Cc:      []string{"c1@x.com"},
+		Bcc:     []string{"b1@x.com"},
+	}
+
+	assert.Len(t, splitRecipients(msg, 0), 1)
+	assert.Len(t, splitRecipients(msg, 5), 1)
+
+	batches := splitRecipients(msg, 2)
+	require.Len(t, batches, 3)
+	assert.Equal(t, []string{"t1@x.com", "t2@x.com"}, batches[0].To)
+	assert.Equal(t, []string{"t3@x.com"}, batches[1].To)
+	assert.Equal(t, []string{"c1@x.com"}, batches[1].Cc)
+	assert.Equal(t, []string{"b1@x.com"}, batches[2].Bcc)
+	assert.Empty(t, batches[2].To)
+	assert.Equal(t, "hi", batches[2].Subject)
+}
+
+func TestAttachmentTypeAllowed(t *testing.T) {
+	config := &Config{BlockedAttachmentExtensions: []string{"exe"}}
+	assert.Error(t, attachmentTypeAllowed(config, "Setup.Exe"))
+	assert.NoError(t, attachmentTypeAllowed(config, "report.pdf"))
+	assert.NoError(t, attachmentTypeAllowed(config, "noextension"))
+
+	config.AllowedAttachmentExtensions = []string{".pdf", "csv"}
+	assert.NoError(t, attachmentTypeAllowed(config, "report.PDF"))
+	assert.Error(t, attachmentTypeAllowed(config, "notes.txt"))
+	assert.Error(t, attachmentTypeAllowed(config, "noextension"))
+}
+
+func TestLoadPFXCertificate_WrongPassword(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bridge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pfx, err := pkcs12.Modern.Encode(key, cert, nil, "right")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cert.pfx")
+	require.NoError(t, os.WriteFile(path, pfx, 0o600))
+
+	_, _, err = loadPFXCertificate(&Config{CertPath: path, CertPassword: "right"})
+	require.NoError(t, err)
+
+	_, _, err = loadPFXCertificate(&Config{CertPath: path, CertPassword: "stale"})
+	assert.True(t, errors.Is(err, errCertPassword), "got %v", err)
+
+	// A damaged file is not reported as a password problem
+	require.NoError(t, os.WriteFile(path, pfx[:len(pfx)/2], 0o600))
+	_, _, err = loadPFXCertificate(&Config{CertPath: path, CertPassword: "right"})
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, errCertPassword), "got %v", err)
+}
+
+func TestCanonicalAuthHeader(t *testing.T) {
+	name, err := canonicalAuthHeader(" arc-seal")
+	require.NoError(t, err)
+	assert.Equal(t, "ARC-Seal", name)
+
+	_, err = canonicalAuthHeader("DKIM-Signature")
+	assert.ErrorContains(t, err, "re-signs")
+	_, err = canonicalAuthHeader("X-Mailer")
+	assert.Error(t, err)
+}
+
+func TestCanonicalForwardHeader(t *testing.T) {
+	name, err := canonicalForwardHeader(" list-unsubscribe-post")
+	require.NoError(t, err)
+	assert.Equal(t, "List-Unsubscribe-Post", name)
+
+	for _, bad := range []string{"bcc", "Reply-To", "Content-Type", "Authentication-Results", "X-Send-At", "Bad Name", ""} {
+		_, err := canonicalForwardHeader(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	at, err := parseSendAt("Fri, 01 Mar 2024 14:30:00 +0100", now)
+	require.NoError(t, err)
+	assert.True(t, at.Equal(time.Date(2024, 3, 1, 13, 30, 0, 0, time.UTC)))
+
+	at, err = parseSendAt("2024-03-05T08:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, 5, at.Day())
+
+	at, err = parseSendAt("2024-03-01T11:59:30Z", now)
+	require.NoError(t, err)
+	assert.True(t, at.IsZero(), "slightly past times send immediately")
+
+	_, err = parseSendAt("2024-02-28T12:00:00Z", now)
+	assert.ErrorContains(t, err, "past")
+	_, err = parseSendAt("2024-06-01T12:00:00Z", now)
+	assert.ErrorContains(t, err, "days ahead")
+	_, err = parseSendAt("tomorrow", now)
+	assert.Error(t, err)
+
+	message := buildGraphMessage("bridge@example.com", &outgoingMessage{SendAt: time.Date(2024, 3, 5, 9, 0, 0, 0, time.FixedZone("CET", 3600))})
+	props := message.GetSingleValueExtendedProperties()
+	require.Len(t, props, 1)
+	assert.Equal(t, propDeferredSendTime, *props[0].GetId())
+	assert.Equal(t, "2024-03-05T08:00:00Z", *props[0].GetValue())
+}
+
+func TestSendingMailboxes(t *testing.T) {
+	b := newTestBackend(&Config{
+		FallbackEmailFrom: "fallback@contoso.com",
+		SenderMailboxes:   map[string]string{"brandb.com": "shared-b@contoso.com", "branda.com": "shared-a@contoso.com", "brandc.com": "Bridge@example.com"},
+	})
+	assert.Equal(t, []string{"bridge@example.com", "fallback@contoso.com", "shared-a@contoso.com", "shared-b@contoso.com"}, b.sendingMailboxes())
+}
+
+func TestStartupSelfTest(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+	require.NoError(t, b.startupSelfTest())
+	assert.Empty(t, sender.messages, "off without startup_test_recipient")
+
+	b.config.StartupTestRecipient = "ops@contoso.com"
+	require.NoError(t, b.startupSelfTest())
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "bridge@example.com", sender.mailbox)
+	assert.Equal(t, "ops@contoso.com", *sender.messages[0].GetToRecipients()[0].GetEmailAddress().GetAddress())
+
+	// A failure only warns, unless startup_test_fail asks to abort
+	sender.err = newODataError(403, "ErrorAccessDenied")
+	assert.NoError(t, b.startupSelfTest())
+	b.config.StartupTestFail = true
+	err := b.startupSelfTest()
+	assert.ErrorContains(t, err, "failed to send test message")
+	assert.Len(t, sender.messages, 3)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsPrefix = "smtp_graph_bridge_"
+
+// Metrics is a minimal registry of counters and gauges rendered in the
+// Prometheus text exposition format. Series names may carry labels, e.g.
+// `sends_total{mailbox="a@b.com"}`; everything before `{` is the family name.
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]float64
+	kinds  map[string]string
+	help   map[string]string
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		values: make(map[string]float64),
+		kinds:  make(map[string]string),
+		help:   make(map[string]string),
+	}
+}
+
+func metricFamily(name string) string {
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func (m *Metrics) register(name, kind, help string) {
+	family := metricFamily(name)
+	if _, ok := m.kinds[family]; !ok {
+		m.kinds[family] = kind
+		m.help[family] = help
+	}
+}
+
+// Add increments a counter by delta.
+func (m *Metrics) Add(name, help string, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.register(name, "counter", help)
+	m.values[name] += delta
+}
+
+// Inc increments a counter by one.
+func (m *Metrics) Inc(name, help string) {
+	m.Add(name, help, 1)
+}
+
+// Set sets a gauge to an absolute value.
+func (m *Metrics) Set(name, help string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.register(name, "gauge", help)
+	m.values[name] = value
+}
+
+// Get returns the current value of a series (0 if never recorded).
+func (m *Metrics) Get(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[name]
+}
+
+func (m *Metrics) writeText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		fi, fj := metricFamily(names[i]), metricFamily(names[j])
+		if fi != fj {
+			return fi < fj
+		}
+		return names[i] < names[j]
+	})
+
+	lastFamily := ""
+	for _, name := range names {
+		family := metricFamily(name)
+		if family != lastFamily {
+			fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, family, m.help[family])
+			fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, family, m.kinds[family])
+			lastFamily = family
+		}
+		fmt.Fprintf(w, "%s%s %g\n", metricsPrefix, name, m.values[name])
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeText(w)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// mimeSensitivity maps PidTagSensitivity values back to Sensitivity header
+// values for MIME sends.
+var mimeSensitivity = map[string]string{
+	"1": "Personal",
+	"2": "Private",
+	"3": "Company-Confidential",
+}
+
+// useMIME reports whether msg is sent as MIME so it can carry a text
+// alternative (generate_text_alternative). Categories and deferred delivery
+// only exist as Graph message properties, so those messages stay JSON.
+func useMIME(cfg *Config, msg *outgoingMessage) bool {
+	return cfg.GenerateTextAlternative && msg.ContentType == "html" &&
+		len(msg.Categories) == 0 && msg.SendAt.IsZero()
+}
+
+// buildMIMEMessage renders msg, sent as mailbox, as a MIME message whose
+// body is multipart/alternative: the text alternative (or the HTML converted
+// to text, with links kept as URLs) followed by the HTML. Attachments wrap
+// it in multipart/mixed.
+func buildMIMEMessage(mailbox string, msg *outgoingMessage) ([]byte, error) {
+	var h mail.Header
+	if msg.SendOnBehalf && msg.From != nil && !strings.EqualFold(msg.From.Address, mailbox) {
+		h.SetAddressList("From", []*mail.Address{{Name: msg.From.Name, Address: msg.From.Address}})
+		h.SetAddressList("Sender", []*mail.Address{{Address: mailbox}})
+	} else {
+		h.SetAddressList("From", []*mail.Address{{Name: msg.FromName, Address: mailbox}})
+	}
+	for _, field := range []struct {
+		name  string
+		addrs []string
+	}{
+		{"To", msg.To},
+		{"Cc", msg.Cc},
+		{"Bcc", bccRecipients(msg)},
+		{"Reply-To", msg.ReplyTo},
+	} {
+		if len(field.addrs) > 0 {
+			h.SetAddressList(field.name, mimeAddresses(field.addrs))
+		}
+	}
+	h.SetSubject(msg.Subject)
+	h.SetDate(time.Now())
+	if !msg.Date.IsZero() {
+		h.Set("X-Original-Date", msg.Date.Format(time.RFC1123Z))
+	}
+
+	for _, f := range [][2]string{
+		{"In-Reply-To", msg.InReplyTo},
+		{"References", msg.References},
+		{"Sensitivity", mimeSensitivity[msg.Sensitivity]},
+		{"Auto-Submitted", msg.AutoSubmitted},
+		{"Precedence", msg.Precedence},
+	} {
+		if f[1] != "" {
+			h.Set(f[0], f[1])
+		}
+	}
+	if isAutomated(msg.AutoSubmitted, msg.Precedence) {
+		h.Set("X-Auto-Response-Suppress", "All")
+	}
+	for _, hdr := range msg.Headers {
+		h.Add(hdr.Name, hdr.Value)
+	}
+
+	text := msg.TextBody
+	if strings.TrimSpace(text) == "" {
+		text = htmlToText(msg.Body)
+	}
+
+	var buf bytes.Buffer
+	var alt *mail.InlineWriter
+	var mw *mail.Writer
+	var err error
+	if len(msg.Attachments) == 0 {
+		alt, err = mail.CreateInlineWriter(&buf, h)
+	} else {
+		if mw, err = mail.CreateWriter(&buf, h); err == nil {
+			alt, err = mw.CreateInline()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", text},
+		{"text/html", msg.Body},
+	} {
+		var ph mail.InlineHeader
+		ph.SetContentType(part.contentType, map[string]string{"charset": "utf-8"})
+		w, err := alt.CreatePart(ph)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+
+	if mw != nil {
+		for _, a := range msg.Attachments {
+			var ah mail.AttachmentHeader
+			ah.Set("Content-Type", a.ContentType)
+			ah.SetFilename(a.Name)
+			w, err := mw.CreateAttachment(ah)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(a.Content); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func mimeAddresses(addrs []string) []*mail.Address {
+	out := make([]*mail.Address, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, &mail.Address{Address: a})
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ndrMessage builds the non-delivery report for msg: a plain-text bounce
+// to the message's author listing each failed recipient and why.
+func ndrMessage(msg *outgoingMessage, failed []recipientResult) *outgoingMessage {
+	var body strings.Builder
+	body.WriteString("Your message could not be delivered to one or more recipients.\n\n")
+	fmt.Fprintf(&body, "Subject: %s\n", msg.Subject)
+	if !msg.Date.IsZero() {
+		fmt.Fprintf(&body, "Sent: %s\n", msg.Date.Format(time.RFC1123Z))
+	}
+	body.WriteString("\nFailed recipients:\n")
+	for _, r := range failed {
+		reason := r.Error
+		if reason == "" {
+			reason = "delivery failed"
+		}
+		fmt.Fprintf(&body, "  %s: %s\n", r.Address, reason)
+	}
+	body.WriteString("\nThis report was generated automatically by smtp-graph-bridge.\n")
+
+	return &outgoingMessage{
+		To:          []string{msg.From.Address},
+		Subject:     "Undeliverable: " + msg.Subject,
+		Body:        body.String(),
+		ContentType: "text",
+		FromName:    "Mail Delivery System",
+		InReplyTo:   msg.InReplyTo,
+		References:  msg.References,
+		// RFC 3834: marks the report as automatic, so it is never bounced
+		// or auto-replied to in turn
+		AutoSubmitted: "auto-replied",
+		NullSender:    true,
+		Date:          time.Now(),
+	}
+}
+
+// ndrSkipReason says why msg gets no report, or "" if it should get one.
+// Null-sender and automatic messages are never bounced (RFC 5321 section
+// 4.5.5, RFC 3834), which also keeps reports from looping.
+func ndrSkipReason(msg *outgoingMessage) string {
+	switch {
+	case msg.NullSender:
+		return "null sender"
+	case msg.From == nil || msg.From.Address == "":
+		return "no From address"
+	case isAutomated(msg.AutoSubmitted, ""):
+		return "automatic message"
+	}
+	return ""
+}
+
+// newNDR returns the non-delivery report for the failed recipients of a
+// queued message (generate_ndr), or nil if none should be sent. The report
+// is itself a null-sender, auto-submitted message, so it never bounces in
+// turn. redirect_all_to applies to it like any other message.
+func (b *Backend) newNDR(msg *outgoingMessage, failed []recipientResult) *outgoingMessage {
+	if !b.config.GenerateNDR || len(failed) == 0 {
+		return nil
+	}
+	if reason := ndrSkipReason(msg); reason != "" {
+		b.logger.Info("Not sending non-delivery report", "reason", reason, "failed_count", len(failed))
+		return nil
+	}
+	ndr := ndrMessage(msg, failed)
+	b.redirectRecipients(ndr, b.logger)
+	return ndr
+}
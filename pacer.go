@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sendPacer spaces out Graph sends per mailbox so each stays under
+// mailbox_send_rate messages per minute, delaying sends instead of letting
+// Exchange answer 429. A nil pacer doesn't pace.
+type sendPacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time // earliest time of the next send per mailbox
+}
+
+func newSendPacer(perMinute int) *sendPacer {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &sendPacer{
+		interval: time.Minute / time.Duration(perMinute),
+		next:     make(map[string]time.Time),
+	}
+}
+
+// maxPacingDelay caps how long a send waits for its slot. It stays well
+// below SMTP clients' DATA timeouts; a send that would wait longer fails
+// with errPacingBacklog instead, without booking a slot.
+const maxPacingDelay = 30 * time.Second
+
+// errPacingBacklog is returned when mailbox_send_rate would delay a send by
+// more than maxPacingDelay.
+var errPacingBacklog = errors.New("mailbox_send_rate backlog: the next send slot for this mailbox is too far out")
+
+// reserve books the next send slot for mailbox and returns how long the
+// caller has to wait for it. Slots more than max away are not booked.
+func (p *sendPacer) reserve(mailbox string, now time.Time, max time.Duration) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slot := now
+	if next := p.next[mailbox]; next.After(now) {
+		slot = next
+	}
+	if slot.Sub(now) > max {
+		return 0, errPacingBacklog
+	}
+	p.next[mailbox] = slot.Add(p.interval)
+	return slot.Sub(now), nil
+}
+
+// wait blocks until mailbox may send again, or returns errPacingBacklog if
+// that is more than maxPacingDelay away.
+func (p *sendPacer) wait(mailbox string) error {
+	if p == nil {
+		return nil
+	}
+	delay, err := p.reserve(mailbox, time.Now(), maxPacingDelay)
+	if err != nil {
+		metrics.Inc(fmt.Sprintf("sends_pacing_rejected_total{mailbox=%q}", mailbox), "Total sends failed because mailbox_send_rate would delay them too long.")
+		return err
+	}
+	metrics.Set(fmt.Sprintf("send_pacing_delay_seconds{mailbox=%q}", mailbox), "Delay applied to the latest send per mailbox by mailbox_send_rate.", delay.Seconds())
+	if delay > 0 {
+		metrics.Inc(fmt.Sprintf("sends_paced_total{mailbox=%q}", mailbox), "Total sends delayed by mailbox_send_rate.")
+		time.Sleep(delay)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendPacer(t *testing.T) {
+	assert.Nil(t, newSendPacer(0))
+
+	p := newSendPacer(30) // one send every 2s
+	now := time.Now()
+	reserve := func(mailbox string, at time.Time) time.Duration {
+		delay, err := p.reserve(mailbox, at, time.Hour)
+		require.NoError(t, err)
+		return delay
+	}
+	assert.Zero(t, reserve("a@example.com", now))
+	assert.Equal(t, 2*time.Second, reserve("a@example.com", now))
+	assert.Equal(t, 4*time.Second, reserve("a@example.com", now))
+	assert.Zero(t, reserve("b@example.com", now), "mailboxes are paced independently")
+
+	// Idle time isn't banked
+	assert.Zero(t, reserve("a@example.com", now.Add(time.Minute)))
+}
+
+func TestSendPacer_MaxDelay(t *testing.T) {
+	p := newSendPacer(2) // one send every 30s
+	now := time.Now()
+	_, err := p.reserve("a@example.com", now, 10*time.Second)
+	require.NoError(t, err)
+
+	// Too far out: refused, and no slot is booked
+	_, err = p.reserve("a@example.com", now, 10*time.Second)
+	assert.ErrorIs(t, err, errPacingBacklog)
+	_, err = p.reserve("a@example.com", now, 10*time.Second)
+	assert.ErrorIs(t, err, errPacingBacklog)
+	delay, err := p.reserve("a@example.com", now.Add(25*time.Second), 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, delay)
+
+	assert.Equal(t, 451, classifyGraphError(errPacingBacklog).Reply.Code)
+}
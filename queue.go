@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry backoff: 30s, 1m, 2m, ... capped at 1h
+const (
+	queueBaseBackoff = 30 * time.Second
+	queueMaxBackoff  = time.Hour
+	queuePollEvery   = time.Second
+)
+
+// queueItem is a message waiting for (re)delivery. Items are persisted as
+// JSON files in queue_dir so they survive restarts; without queue_dir they
+// only live in memory.
+type queueItem struct {
+	ID        string           `json:"id"`
+	Mailbox   string           `json:"mailbox"`
+	Message   *outgoingMessage `json:"message"`
+	Attempts  int              `json:"attempts"`
+	CreatedAt time.Time        `json:"created_at"`
+	NextRetry time.Time        `json:"next_retry"`
+	LastError string           `json:"last_error,omitempty"`
+
+	// Per-recipient outcome. With recipient_batch_size some batches can
+	// be delivered while others fail; only pending recipients are retried.
+	Recipients []recipientResult `json:"recipients,omitempty"`
+}
+
+// Recipient delivery states
+const (
+	recipientPending = "pending"
+	recipientSent    = "sent"
+	recipientFailed  = "failed"
+)
+
+// recipientResult is the delivery state of one recipient of a queued
+// message.
+type recipientResult struct {
+	Address   string    `json:"address"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// pendingRecipients lists every recipient of msg as pending.
+func pendingRecipients(msg *outgoingMessage) []recipientResult {
+	var results []recipientResult
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, addr := range list {
+			results = append(results, recipientResult{Address: addr, Status: recipientPending})
+		}
+	}
+	return results
+}
+
+// setRecipients records the outcome of a send to every recipient of batch.
+func (item *queueItem) setRecipients(batch *outgoingMessage, status, errText string, now time.Time) {
+	for _, list := range [][]string{batch.To, batch.Cc, batch.Bcc} {
+		for _, addr := range list {
+			for i := range item.Recipients {
+				if r := &item.Recipients[i]; strings.EqualFold(r.Address, addr) && r.Status == recipientPending {
+					r.Status, r.Error, r.UpdatedAt = status, errText, now
+					break
+				}
+			}
+		}
+	}
+}
+
+// recipientsWith returns the addresses in the given state.
+func (item *queueItem) recipientsWith(status string) []string {
+	var addrs []string
+	for _, r := range item.Recipients {
+		if r.Status == status {
+			addrs = append(addrs, r.Address)
+		}
+	}
+	return addrs
+}
+
+// retryQueue redelivers messages whose Graph send failed temporarily. Items
+// that exhaust max retries, or fail permanently, are moved to the
+// dead-letter directory together with the failure reason.
+type retryQueue struct {
+	dir           string
+	deadletterDir string
+	maxRetries    int
+	sendJitter    time.Duration // max random delay before each queued send
+	backend       *Backend
+	logger        *slog.Logger
+
+	mu    sync.Mutex
+	items map[string]*queueItem
+}
+
+func newRetryQueue(config *Config, b *Backend) (*retryQueue, error) {
+	deadletterDir := config.DeadletterDir
+	if deadletterDir == "" && config.QueueDir != "" {
+		deadletterDir = filepath.Join(config.QueueDir, "deadletter")
+	}
+	for _, dir := range []string{config.QueueDir, deadletterDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create queue directory: %w", err)
+		}
+	}
+
+	q := &retryQueue{
+		dir:           config.QueueDir,
+		deadletterDir: deadletterDir,
+		maxRetries:    config.QueueMaxRetries,
+		sendJitter:    config.QueueSendJitter,
+		backend:       b,
+		logger:        b.logger.WithGroup("queue"),
+		items:         make(map[string]*queueItem),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load picks up items persisted by a previous run.
+func (q *retryQueue) load() error {
+	if q.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read queued message: %w", err)
+		}
+		var item queueItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			q.logger.Error("Skipping corrupt queue file", "path", path, "error", err)
+			continue
+		}
+		if item.Recipients == nil {
+			item.Recipients = pendingRecipients(item.Message)
+		}
+		q.items[item.ID] = &item
+	}
+	q.updateMetrics()
+	if len(q.items) > 0 {
+		q.logger.Info("Loaded queued messages", "count", len(q.items))
+	}
+	return nil
+}
+
+func newQueueID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Enqueue persists msg for delivery at the given time.
+func (q *retryQueue) Enqueue(mailbox string, msg *outgoingMessage, attempts int, lastErr string, next time.Time) (string, error) {
+	item := &queueItem{
+		ID:         newQueueID(),
+		Mailbox:    mailbox,
+		Message:    msg,
+		Attempts:   attempts,
+		CreatedAt:  time.Now(),
+		NextRetry:  next,
+		LastError:  lastErr,
+		Recipients: pendingRecipients(msg),
+	}
+
+	return q.add(item)
+}
+
+// EnqueueRemaining queues the part of a direct send that failed
+// temporarily, as its first failed attempt. Recipients already delivered
+// are recorded as sent and those that failed permanently as failed, so
+// neither is sent to again.
+func (q *retryQueue) EnqueueRemaining(mailbox string, msg *outgoingMessage, results []batchResult, now time.Time) (string, error) {
+	item := &queueItem{
+		ID:         newQueueID(),
+		Mailbox:    mailbox,
+		Attempts:   1,
+		CreatedAt:  now,
+		NextRetry:  now.Add(retryBackoff(1)),
+		Recipients: pendingRecipients(msg),
+	}
+	retry, err := item.recordResults(msg, results, isTemporarySendError, now)
+	if retry == nil {
+		return "", fmt.Errorf("no recipients left to retry")
+	}
+	item.Message = retry
+	if err != nil {
+		item.LastError = err.Error()
+	}
+	return q.add(item)
+}
+
+func (q *retryQueue) add(item *queueItem) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.addLocked(item)
+}
+
+// addLocked is add for callers that hold q.mu.
+func (q *retryQueue) addLocked(item *queueItem) (string, error) {
+	if err := q.persist(item); err != nil {
+		return "", err
+	}
+	q.items[item.ID] = item
+	q.updateMetrics()
+	return item.ID, nil
+}
+
+// hasTemporaryFailure reports whether any batch failed with an error worth
+// retrying.
+func hasTemporaryFailure(results []batchResult) bool {
+	for _, r := range results {
+		if r.Err != nil && isTemporarySendError(r.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordResults applies the outcome of sending msg to item's recipients.
+// Failed batches for which retryable reports true stay pending; it returns
+// them as the message to retry (nil if there are none) and the last error.
+func (item *queueItem) recordResults(msg *outgoingMessage, results []batchResult, retryable func(error) bool, now time.Time) (*outgoingMessage, error) {
+	retry := *msg
+	retry.To, retry.Cc, retry.Bcc = nil, nil, nil
+	var err error
+	for _, r := range results {
+		if r.Err == nil {
+			item.setRecipients(r.Batch, recipientSent, "", now)
+			continue
+		}
+		err = r.Err
+		if retryable(r.Err) {
+			item.setRecipients(r.Batch, recipientPending, r.Err.Error(), now)
+			retry.To = append(retry.To, r.Batch.To...)
+			retry.Cc = append(retry.Cc, r.Batch.Cc...)
+			retry.Bcc = append(retry.Bcc, r.Batch.Bcc...)
+			continue
+		}
+		item.setRecipients(r.Batch, recipientFailed, r.Err.Error(), now)
+	}
+	if len(retry.To)+len(retry.Cc)+len(retry.Bcc) == 0 {
+		return nil, err
+	}
+	return &retry, err
+}
+
+func (q *retryQueue) itemPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// persist writes item atomically (write + rename). Callers hold q.mu.
+func (q *retryQueue) persist(item *queueItem) error {
+	if q.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	tmp := q.itemPath(item.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("failed to write queued message: %w", err)
+	}
+	return os.Rename(tmp, q.itemPath(item.ID))
+}
+
+// Run delivers due items until ctx is cancelled.
+func (q *retryQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(queuePollEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, item := range q.due(time.Now()) {
+				// Spread bursts (e.g. draining after an outage) so the
+				// sends don't all hit Graph's throttling at once
+				if d := q.jitterDelay(); d > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(d):
+					}
+				}
+				q.deliver(item)
+			}
+		}
+	}
+}
+
+// jitterDelay returns a random delay in [0, sendJitter).
+func (q *retryQueue) jitterDelay() time.Duration {
+	if q.sendJitter <= 0 {
+		return 0
+	}
+	return mrand.N(q.sendJitter)
+}
+
+// due returns items whose retry time has passed, oldest first.
+func (q *retryQueue) due(now time.Time) []*queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var items []*queueItem
+	for _, item := range q.items {
+		if !item.NextRetry.After(now) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+	return items
+}
+
+func (q *retryQueue) deliver(item *queueItem) {
+	results := q.backend.sendBatches(item.Mailbox, item.Message)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.items[item.ID]; !ok {
+		return // removed while we were sending
+	}
+
+	item.Attempts++
+	now := time.Now()
+	retry, err := item.recordResults(item.Message, results, func(err error) bool {
+		return isTemporarySendError(err) && item.Attempts < q.maxRetries
+	}, now)
+
+	if err == nil && len(item.recipientsWith(recipientFailed)) == 0 {
+		q.logger.Info("Queued message delivered", "id", item.ID, "attempts", item.Attempts)
+		q.remove(item.ID)
+		return
+	}
+	if err != nil {
+		item.LastError = err.Error()
+	}
+
+	if retry == nil {
+		// Nothing left to retry. Recipients that failed permanently are
+		// recorded in the dead-letter copy.
+		if sent := item.recipientsWith(recipientSent); len(sent) > 0 {
+			q.logger.Warn("Queued message partially delivered", "id", item.ID,
+				"sent", sent, "failed", item.recipientsWith(recipientFailed))
+		}
+		q.deadLetter(item)
+		return
+	}
+
+	// Retry only the recipients that failed temporarily, so the ones
+	// already delivered don't get the message twice
+	item.Message = retry
+	item.NextRetry = now.Add(retryBackoff(item.Attempts))
+	if perr := q.persist(item); perr != nil {
+		q.logger.Error("Failed to update queued message", "id", item.ID, "error", perr)
+	}
+	q.logger.Warn("Queued delivery failed, will retry", "id", item.ID, "attempts", item.Attempts,
+		"pending", len(item.recipientsWith(recipientPending)), "next_retry", item.NextRetry, "error", err)
+}
+
+// isTemporarySendError reports whether a failed send is worth retrying:
+// token failures and anything we'd answer with a 4xx.
+func isTemporarySendError(err error) bool {
+	return isTokenError(err) || classifyGraphError(err).Reply.Code < 500
+}
+
+func retryBackoff(attempts int) time.Duration {
+	backoff := queueBaseBackoff
+	for i := 1; i < attempts && backoff < queueMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, queueMaxBackoff)
+}
+
+// deadLetter moves item to the dead-letter directory with a .reason file
+// next to it. Without a dead-letter directory the item is logged and
+// dropped. Callers hold q.mu.
+func (q *retryQueue) deadLetter(item *queueItem) {
+	if q.deadletterDir == "" {
+		q.logger.Error("Message dropped after failed delivery, no deadletter_dir configured",
+			"id", item.ID, "attempts", item.Attempts, "to", item.Message.To, "error", item.LastError)
+		metrics.Inc("deadlettered_total", "Total messages moved to the dead-letter directory.")
+		q.bounce(item)
+		q.remove(item.ID)
+		return
+	}
+
+	data, _ := json.MarshalIndent(item, "", "  ")
+	base := filepath.Join(q.deadletterDir, item.ID)
+	if err := os.WriteFile(base+".json", data, 0o640); err != nil {
+		// Keep it queued rather than lose it; try again after a backoff
+		q.logger.Error("Failed to write dead-letter message, keeping it queued", "id", item.ID, "error", err)
+		item.NextRetry = time.Now().Add(queueMaxBackoff)
+		q.persist(item)
+		return
+	}
+	reason := fmt.Sprintf("attempts: %d\nfailed_at: %s\nmailbox: %s\nrecipients: %s\nerror: %s\n",
+		item.Attempts, time.Now().Format(time.RFC3339), item.Mailbox,
+		strings.Join(item.Message.To, ", "), item.LastError)
+	for _, r := range item.Recipients {
+		reason += fmt.Sprintf("recipient: %s %s", r.Address, r.Status)
+		if r.Error != "" {
+			reason += ": " + r.Error
+		}
+		reason += "\n"
+	}
+	os.WriteFile(base+".reason.txt", []byte(reason), 0o640)
+
+	q.logger.Error("Message moved to dead-letter directory", "id", item.ID, "attempts", item.Attempts, "error", item.LastError)
+	metrics.Inc("deadlettered_total", "Total messages moved to the dead-letter directory.")
+	q.bounce(item)
+	q.remove(item.ID)
+}
+
+// bounce queues a non-delivery report for the recipients of item that
+// failed (generate_ndr). The client was told the message was accepted, so
+// this is the only way its author learns of the failure. The report is a
+// queue item of its own, so it is retried and persisted like any other
+// message. Callers hold q.mu.
+func (q *retryQueue) bounce(item *queueItem) {
+	var failed []recipientResult
+	for _, r := range item.Recipients {
+		if r.Status == recipientFailed {
+			failed = append(failed, r)
+		}
+	}
+	ndr := q.backend.newNDR(item.Message, failed)
+	if ndr == nil {
+		return
+	}
+	now := time.Now()
+	id, err := q.addLocked(&queueItem{
+		ID:         newQueueID(),
+		Mailbox:    item.Mailbox,
+		Message:    ndr,
+		CreatedAt:  now,
+		NextRetry:  now,
+		Recipients: pendingRecipients(ndr),
+	})
+	if err != nil {
+		q.logger.Error("Failed to queue non-delivery report", "id", item.ID, "error", err)
+		metrics.Inc("ndr_errors_total", "Total non-delivery reports that could not be queued.")
+		return
+	}
+	q.logger.Info("Non-delivery report queued", "id", item.ID, "ndr_id", id, "failed_count", len(failed))
+	metrics.Inc("ndr_queued_total", "Total non-delivery reports queued for permanently failed recipients.")
+}
+
+// queueEntry is the admin API's view of a queued message.
+type queueEntry struct {
+	ID        string    `json:"id"`
+	Mailbox   string    `json:"mailbox"`
+	Subject   string    `json:"subject"`
+	To        []string  `json:"to"`
+	Cc        []string  `json:"cc,omitempty"`
+	Bcc       []string  `json:"bcc,omitempty"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	NextRetry time.Time `json:"next_retry"`
+	LastError string    `json:"last_error,omitempty"`
+
+	Recipients []recipientResult `json:"recipients,omitempty"`
+}
+
+// List returns the queued messages, oldest first.
+func (q *retryQueue) List() []queueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]queueEntry, 0, len(q.items))
+	for _, item := range q.items {
+		entries = append(entries, queueEntry{
+			ID:         item.ID,
+			Mailbox:    item.Mailbox,
+			Subject:    item.Message.Subject,
+			To:         item.Message.To,
+			Cc:         item.Message.Cc,
+			Bcc:        item.Message.Bcc,
+			Attempts:   item.Attempts,
+			CreatedAt:  item.CreatedAt,
+			NextRetry:  item.NextRetry,
+			LastError:  item.LastError,
+			Recipients: item.Recipients,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	return entries
+}
+
+// Drop removes a queued message without delivering it and reports whether
+// it was queued. A send already in flight still completes.
+func (q *retryQueue) Drop(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.items[id]; !ok {
+		return false
+	}
+	q.remove(id)
+	return true
+}
+
+// remove drops an item from memory and disk. Callers hold q.mu.
+func (q *retryQueue) remove(id string) {
+	delete(q.items, id)
+	if q.dir != "" {
+		if err := os.Remove(q.itemPath(id)); err != nil && !os.IsNotExist(err) {
+			q.logger.Error("Failed to delete queue file", "id", id, "error", err)
+		}
+	}
+	q.updateMetrics()
+}
+
+func (q *retryQueue) updateMetrics() {
+	metrics.Set("queue_length", "Messages waiting in the retry queue.", float64(len(q.items)))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryQueue_PersistAndDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{QueueDir: dir, QueueMaxRetries: 3}
+	q, err := newRetryQueue(config, newTestBackend(config))
+	require.NoError(t, err)
+
+	msg := &outgoingMessage{To: []string{"a@example.com"}, Subject: "Hi", Body: "body", ContentType: "text"}
+	id, err := q.Enqueue("bridge@example.com", msg, 1, "graph error", time.Now())
+	require.NoError(t, err)
+
+	// A fresh queue picks the item up from disk
+	reloaded, err := newRetryQueue(config, newTestBackend(config))
+	require.NoError(t, err)
+	require.Contains(t, reloaded.items, id)
+	assert.Equal(t, "Hi", reloaded.items[id].Message.Subject)
+
+	before := metrics.Get("deadlettered_total")
+	q.mu.Lock()
+	q.deadLetter(q.items[id])
+	q.mu.Unlock()
+
+	assert.NoFileExists(t, filepath.Join(dir, id+".json"))
+	assert.FileExists(t, filepath.Join(dir, "deadletter", id+".json"))
+	reason, err := os.ReadFile(filepath.Join(dir, "deadletter", id+".reason.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(reason), "error: graph error")
+	assert.Equal(t, before+1, metrics.Get("deadlettered_total"))
+}
+
+// recipientSender fails sends to the listed To addresses.
+type recipientSender struct {
+	mu       sync.Mutex
+	fail     map[string]error
+	sent     []string
+	messages []models.Messageable
+}
+
+func (f *recipientSender) Send(ctx context.Context, mailbox string, msg models.Messageable) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addr := *msg.GetToRecipients()[0].GetEmailAddress().GetAddress()
+	if err := f.fail[addr]; err != nil {
+		return err
+	}
+	f.sent = append(f.sent, addr)
+	f.messages = append(f.messages, msg)
+	return nil
+}
+
+func TestRetryQueue_RecipientResults(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{QueueDir: dir, QueueMaxRetries: 3, RecipientBatchSize: 1, GraphTimeout: time.Second}
+	b := newTestBackend(config)
+	sender := &recipientSender{fail: map[string]error{
+		"busy@example.com":    newODataError(503, "ServiceUnavailable"),
+		"missing@example.com": newODataError(400, "ErrorInvalidRecipients"),
+	}}
+	b.sender = sender
+	q, err := newRetryQueue(config, b)
+	require.NoError(t, err)
+
+	msg := &outgoingMessage{
+		To:      []string{"ok@example.com", "busy@example.com", "missing@example.com"},
+		Subject: "Hi", Body: "body", ContentType: "text",
+	}
+	id, err := q.Enqueue("bridge@example.com", msg, 0, "", time.Now())
+	require.NoError(t, err)
+
+	status := func() map[string]string {
+		statuses := map[string]string{}
+		for _, r := range q.List()[0].Recipients {
+			statuses[r.Address] = r.Status
+		}
+		return statuses
+	}
+
+	// Only the temporarily failed recipient stays queued
+	q.deliver(q.items[id])
+	require.Contains(t, q.items, id)
+	assert.Equal(t, map[string]string{
+		"ok@example.com":      recipientSent,
+		"busy@example.com":    recipientPending,
+		"missing@example.com": recipientFailed,
+	}, status())
+	assert.Equal(t, []string{"busy@example.com"}, q.items[id].Message.To)
+
+	// The retry doesn't resend to recipients already delivered; once
+	// nothing is pending the permanent failure is dead-lettered
+	delete(sender.fail, "busy@example.com")
+	q.deliver(q.items[id])
+	assert.Equal(t, []string{"ok@example.com", "busy@example.com"}, sender.sent)
+	assert.NotContains(t, q.items, id)
+	reason, err := os.ReadFile(filepath.Join(dir, "deadletter", id+".reason.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(reason), "recipient: busy@example.com sent")
+	assert.Contains(t, string(reason), "recipient: missing@example.com failed: ")
+}
+
+func TestRetryQueue_NDR(t *testing.T) {
+	config := &Config{QueueMaxRetries: 3, GraphTimeout: time.Second, GenerateNDR: true}
+	b := newTestBackend(config)
+	sender := &recipientSender{fail: map[string]error{
+		"missing@example.com": newODataError(400, "ErrorInvalidRecipients"),
+	}}
+	b.sender = sender
+	q, err := newRetryQueue(config, b)
+	require.NoError(t, err)
+
+	msg := &outgoingMessage{
+		To:      []string{"missing@example.com"},
+		Subject: "Invoice 42", Body: "body", ContentType: "text",
+		From: &mail.Address{Address: "billing@example.com"},
+	}
+	id, err := q.Enqueue("bridge@example.com", msg, 0, "", time.Now())
+	require.NoError(t, err)
+	q.deliver(q.items[id])
+	assert.NotContains(t, q.items, id)
+
+	// The report is queued in its own right, from the same mailbox
+	entries := q.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "bridge@example.com", entries[0].Mailbox)
+	ndrItem := q.items[entries[0].ID]
+	assert.True(t, ndrItem.Message.NullSender, "a report never bounces in turn")
+
+	q.deliver(ndrItem)
+	assert.Empty(t, q.List())
+	require.Len(t, sender.messages, 1)
+	ndr := sender.messages[0]
+	assert.Equal(t, "billing@example.com", *ndr.GetToRecipients()[0].GetEmailAddress().GetAddress())
+	assert.Equal(t, "Undeliverable: Invoice 42", *ndr.GetSubject())
+	assert.Contains(t, *ndr.GetBody().GetContent(), "missing@example.com: ")
+	assert.Contains(t, *ndr.GetBody().GetContent(), "details from Graph", "Graph's reason is included")
+
+	// With redirect_all_to, reports go to the catch-all like everything else
+	config.RedirectAllTo = "catchall@contoso.com"
+	report := b.newNDR(msg, []recipientResult{{Address: "missing@example.com", Status: recipientFailed}})
+	assert.Equal(t, []string{"catchall@contoso.com"}, report.To)
+
+	// Bounces, automatic mail and messages without an author get none
+	assert.Equal(t, "null sender", ndrSkipReason(&outgoingMessage{NullSender: true, From: msg.From}))
+	assert.Equal(t, "automatic message", ndrSkipReason(&outgoingMessage{AutoSubmitted: "auto-replied", From: msg.From}))
+	assert.Equal(t, "no From address", ndrSkipReason(&outgoingMessage{}))
+	assert.Empty(t, ndrSkipReason(msg))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, retryBackoff(1))
+	assert.Equal(t, time.Minute, retryBackoff(2))
+	assert.Equal(t, time.Hour, retryBackoff(20))
+}
+
+func TestRetryQueue_JitterDelay(t *testing.T) {
+	q := &retryQueue{}
+	assert.Zero(t, q.jitterDelay())
+
+	q.sendJitter = 50 * time.Millisecond
+	for range 100 {
+		d := q.jitterDelay()
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.Less(t, d, q.sendJitter)
+	}
+}
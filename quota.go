@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// errDailyLimit is returned for sends over daily_send_limit.
+var errDailyLimit = errors.New("daily send limit reached for this mailbox")
+
+// sendQuota caps Graph sends per mailbox per UTC day (daily_send_limit).
+// Counts reset at midnight UTC. With a state file they survive restarts;
+// without one they start from zero on every start. A nil quota is
+// unlimited.
+type sendQuota struct {
+	mu     sync.Mutex
+	limit  int
+	path   string // "" = in memory only
+	logger *slog.Logger
+
+	state quotaState
+}
+
+// quotaState is the persisted form, one day's counts at a time.
+type quotaState struct {
+	Day    string         `json:"day"` // YYYY-MM-DD, UTC
+	Counts map[string]int `json:"counts"`
+}
+
+func newSendQuota(limit int, path string, logger *slog.Logger) (*sendQuota, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	q := &sendQuota{limit: limit, path: path, logger: logger, state: quotaState{Counts: map[string]int{}}}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daily send counts: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.state); err != nil {
+		return nil, fmt.Errorf("failed to parse daily send counts %s: %w", path, err)
+	}
+	if q.state.Counts == nil {
+		q.state.Counts = map[string]int{}
+	}
+	return q, nil
+}
+
+// take reserves one send for mailbox, or returns errDailyLimit when the
+// day's quota is used up.
+func (q *sendQuota) take(mailbox string, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(now)
+	if q.state.Counts[mailbox] >= q.limit {
+		metrics.Inc(fmt.Sprintf("daily_limit_rejections_total{mailbox=%q}", mailbox), "Total sends refused by daily_send_limit.")
+		return errDailyLimit
+	}
+	q.state.Counts[mailbox]++
+	q.update(mailbox)
+	return nil
+}
+
+// release returns a reservation for a send that failed, so only delivered
+// messages count against the quota.
+func (q *sendQuota) release(mailbox string, now time.Time) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(now)
+	if q.state.Counts[mailbox] > 0 {
+		q.state.Counts[mailbox]--
+		q.update(mailbox)
+	}
+}
+
+// rollover starts a fresh day. Callers hold q.mu.
+func (q *sendQuota) rollover(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if q.state.Day == day {
+		return
+	}
+	for mailbox := range q.state.Counts {
+		metrics.Set(fmt.Sprintf("daily_send_remaining{mailbox=%q}", mailbox), "Sends left today under daily_send_limit.", float64(q.limit))
+	}
+	q.state = quotaState{Day: day, Counts: map[string]int{}}
+}
+
+// update exports the remaining quota and saves the counts. A failed save
+// is not fatal; the in-memory count stays authoritative. Callers hold q.mu.
+func (q *sendQuota) update(mailbox string) {
+	metrics.Set(fmt.Sprintf("daily_send_remaining{mailbox=%q}", mailbox), "Sends left today under daily_send_limit.", float64(q.limit-q.state.Counts[mailbox]))
+	if q.path == "" {
+		return
+	}
+	data, err := json.Marshal(q.state)
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o640); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		q.logger.Warn("Failed to save daily send counts", "path", q.path, "error", err)
+	}
+}
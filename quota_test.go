@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendQuota(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	q, err := newSendQuota(0, "", logger)
+	require.NoError(t, err)
+	assert.Nil(t, q)
+
+	path := filepath.Join(t.TempDir(), "counts.json")
+	q, err = newSendQuota(2, path, logger)
+	require.NoError(t, err)
+	day := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+
+	require.NoError(t, q.take("a@contoso.com", day))
+	require.NoError(t, q.take("a@contoso.com", day))
+	assert.ErrorIs(t, q.take("a@contoso.com", day), errDailyLimit)
+	assert.NoError(t, q.take("b@contoso.com", day), "mailboxes are counted separately")
+	assert.Equal(t, float64(0), metrics.Get(`daily_send_remaining{mailbox="a@contoso.com"}`))
+
+	// Failed sends give their slot back
+	q.release("b@contoso.com", day)
+	assert.Equal(t, float64(2), metrics.Get(`daily_send_remaining{mailbox="b@contoso.com"}`))
+
+	// Counts survive a restart, then reset at midnight UTC
+	q, err = newSendQuota(2, path, logger)
+	require.NoError(t, err)
+	assert.ErrorIs(t, q.take("a@contoso.com", day), errDailyLimit)
+	assert.NoError(t, q.take("a@contoso.com", day.Add(2*time.Hour)))
+
+	assert.Equal(t, 451, classifyGraphError(errDailyLimit).Reply.Code)
+}
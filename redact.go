@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redactedKeys are log attributes that carry end-user email addresses or
+// SMTP usernames. Their whole value is masked, even when it isn't shaped
+// like an address.
+var redactedKeys = map[string]bool{
+	"to":              true,
+	"cc":              true,
+	"bcc":             true,
+	"from":            true,
+	"original":        true,
+	"using":           true,
+	"rewritten":       true,
+	"sent":            true,
+	"failed":          true,
+	"username":        true,
+	"mailbox":         true,
+	"fallback":        true,
+	"email_from":      true,
+	"archive_mailbox": true,
+	"redirect_all_to": true,
+}
+
+// addressPattern finds email addresses inside other log values, such as
+// subjects, Graph request URLs and error messages.
+var addressPattern = regexp.MustCompile(`[\w.!#$%&'*+?^{|}~-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*`)
+
+// redactAddress replaces the local part of addr with a short stable hash,
+// so the same address can still be correlated across log lines and the
+// domain stays visible for troubleshooting.
+func redactAddress(addr string) string {
+	addr = strings.ToLower(addr)
+	sum := sha256.Sum256([]byte(addr))
+	hash := hex.EncodeToString(sum[:6])
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		return hash + addr[at:]
+	}
+	return hash
+}
+
+// redactingHandler masks the attributes listed in redactedKeys, and any
+// email address found in other attributes, before passing records on.
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	mask := redactAddresses
+	if redactedKeys[a.Key] {
+		mask = redactAddress
+	}
+	switch v := a.Value.Any().(type) {
+	case string:
+		if v != "" {
+			return slog.String(a.Key, mask(v))
+		}
+	case []string:
+		masked := make([]string, len(v))
+		for i, s := range v {
+			masked[i] = mask(s)
+		}
+		return slog.Any(a.Key, masked)
+	case error:
+		if msg := v.Error(); addressPattern.MatchString(msg) {
+			return slog.String(a.Key, redactAddresses(msg))
+		}
+	}
+	return a
+}
+
+// redactAddresses masks every email address found in s.
+func redactAddresses(s string) string {
+	return addressPattern.ReplaceAllStringFunc(s, redactAddress)
+}
+
+// secretConfigKey matches config keys whose values are never written to
+// the log: passwords, keys, tokens, certificates and their locations, and
+// URLs that may carry credentials. It goes by key name, so a new setting
+// named like a secret is redacted without anyone having to list it.
+var secretConfigKey = regexp.MustCompile(`(^|_)(pass|password|secret|key|token|pem|cert|webhook)(_|$)|_proxy$`)
+
+// isSecretConfig reports whether the config value under key is redacted.
+// Only text values can hold secrets; numbers and flags such as
+// cert_expiry_warn_days or token_warmup are always shown.
+func isSecretConfig(key string, kind reflect.Kind) bool {
+	return kind == reflect.String && secretConfigKey.MatchString(key)
+}
+
+// configLogAttr renders the effective configuration as one "config" log
+// group keyed like the config file, so the startup log shows what won
+// between environment, config file, .env and defaults. Secrets that are set
+// show as "[redacted]", unset ones stay empty so "missing" is still visible.
+func configLogAttr(config *Config) slog.Attr {
+	v := reflect.ValueOf(*config)
+	t := v.Type()
+	attrs := make([]any, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+		field := v.Field(i)
+		switch {
+		case isSecretConfig(key, field.Kind()):
+			if !field.IsZero() {
+				attrs = append(attrs, slog.String(key, "[redacted]"))
+			} else {
+				attrs = append(attrs, slog.String(key, ""))
+			}
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			attrs = append(attrs, slog.String(key, time.Duration(field.Int()).String()))
+		default:
+			attrs = append(attrs, slog.Any(key, field.Interface()))
+		}
+	}
+	return slog.Group("config", attrs...)
+}
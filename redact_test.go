@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&redactingHandler{Handler: slog.NewJSONHandler(&buf, nil)})
+
+	logger.WithGroup("session").Info("Processing email",
+		"from", "alice@example.com", "to", []string{"bob@contoso.com"}, "subject", "hello")
+
+	out := buf.String()
+	assert.NotContains(t, out, "alice@")
+	assert.NotContains(t, out, "bob@")
+	assert.Contains(t, out, redactAddress("bob@contoso.com"))
+	assert.Contains(t, out, "@contoso.com")
+	assert.Contains(t, out, `"subject":"hello"`)
+	assert.Equal(t, redactAddress("Bob@Contoso.com"), redactAddress("bob@contoso.com"))
+}
+
+func TestRedactingHandler_QueueRecipients(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&redactingHandler{Handler: slog.NewJSONHandler(&buf, nil)})
+
+	logger.Warn("Queued message partially delivered", "id", "abc",
+		"sent", []string{"alice@example.com"}, "failed", []string{"bob@contoso.com"})
+
+	out := buf.String()
+	assert.NotContains(t, out, "alice@")
+	assert.NotContains(t, out, "bob@")
+	assert.Contains(t, out, redactAddress("bob@contoso.com"))
+	assert.Contains(t, out, `"id":"abc"`)
+}
+
+func TestRedactingHandler_AddressValues(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&redactingHandler{Handler: slog.NewJSONHandler(&buf, nil)}).
+		With("mailbox", "sender@contoso.com")
+
+	logger.Info("Rewrote From address",
+		"username", "smtp-app",
+		"rewritten", "app@contoso.com",
+		"subject", "Re: note from carol@example.com",
+		"url", "https://graph.microsoft.com/v1.0/users/dave@contoso.com/sendMail",
+		"error", errors.New("mailbox erin@contoso.com not found"),
+		slog.Group("batch", "recipients", []string{"frank@example.com"}),
+		"helo", "mail.example.com")
+
+	out := buf.String()
+	for _, local := range []string{"sender@", "smtp-app", "app@", "carol@", "dave@", "erin@", "frank@"} {
+		assert.NotContains(t, out, local)
+	}
+	assert.Contains(t, out, redactAddress("smtp-app"))
+	assert.Contains(t, out, "Re: note from "+redactAddress("carol@example.com"))
+	assert.Contains(t, out, "/users/"+redactAddress("dave@contoso.com")+"/sendMail")
+	assert.Contains(t, out, "mailbox "+redactAddress("erin@contoso.com")+" not found")
+	assert.Contains(t, out, `"helo":"mail.example.com"`)
+}
+
+// unredactedLogKeys are log keys whose values are never email addresses
+// or usernames. Addresses that end up in them anyway (a subject, a URL, an
+// error message) are still masked by value. Every key logged by the bridge
+// must be listed here or in redactedKeys; TestLogKeysClassified fails
+// otherwise.
+var unredactedLogKeys = map[string]bool{
+	"active_sessions": true, "address": true, "attempts": true, "batch": true, "batches": true,
+	"build_date": true, "client_ip": true, "commands": true, "commit": true, "component": true,
+	"config": true, "content_type": true, "cooldown": true, "count": true, "days_left": true,
+	"declared_size": true, "delay": true, "delivery_mode": true, "duration": true, "enabled": true,
+	"error": true, "failed_count": true, "file": true, "filename": true, "from_count": true,
+	"go_version": true, "graph_base_url": true, "graph_http": true, "graph_proxy": true,
+	"header_type": true, "helo": true, "id": true, "length": true, "max_connections": true,
+	"max_retries": true, "max_sessions_per_ip": true, "max_subject_length": true, "method": true,
+	"min_version": true, "missing_from_policy": true, "ndr_id": true, "next_retry": true,
+	"not_after": true, "original_recipient_count": true, "path": true, "pending": true,
+	"placeholder": true, "port": true, "queue_dir": true, "queue_id": true, "reason": true,
+	"recipient_count": true, "remote_addr": true, "require_auth": true, "require_valid_helo": true,
+	"resent_from": true, "resent_recipients": true, "reserve_bytes": true, "retry_after": true,
+	"session_id": true, "signal": true, "size_bytes": true, "status": true, "subject": true,
+	"threshold_days": true, "timeout": true, "tls": true, "url": true, "using_envelope": true,
+	"version": true, "x_send_at": true,
+}
+
+// TestLogKeysClassified collects the attribute keys of every logger call in
+// the bridge, so a new key carrying addresses can't slip past redaction.
+func TestLogKeysClassified(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyName := regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			switch sel.Sel.Name {
+			case "Debug", "Info", "Warn", "Error", "With", "Log":
+			default:
+				// slog.String, slog.Any, slog.Group and friends.
+				if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "slog" {
+					return true
+				}
+			}
+			for _, arg := range call.Args {
+				lit, ok := arg.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				key, _ := strconv.Unquote(lit.Value)
+				if keyName.MatchString(key) && !redactedKeys[key] && !unredactedLogKeys[key] {
+					t.Errorf("%s: log key %q must be added to redactedKeys or unredactedLogKeys",
+						fset.Position(lit.Pos()), key)
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestConfigLogAttr(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	logger.Info("Configuration loaded", configLogAttr(&Config{
+		TenantID:     "tenant",
+		CertPath:     "/run/secrets/cert.pfx",
+		CertPassword: "hunter2",
+		AuthPassword: "",
+		GraphTimeout: 30 * time.Second,
+		FromRewrite:  map[string]string{"@legacy.local": "@contoso.com"},
+	}))
+
+	out := buf.String()
+	assert.NotContains(t, out, "hunter2")
+	assert.NotContains(t, out, "/run/secrets")
+	assert.Contains(t, out, `"ms_graph_cert_pass":"[redacted]"`)
+	assert.Contains(t, out, `"smtp_auth_password":""`, "unset secrets stay visibly empty")
+	assert.Contains(t, out, `"ms_graph_tenant_id":"tenant"`)
+	assert.Contains(t, out, `"graph_timeout":"30s"`)
+	assert.Contains(t, out, `"from_rewrite":{"@legacy.local":"@contoso.com"}`)
+}
+
+// publicConfigKeys are the text settings shown in the startup log. Every
+// text setting must either be listed here or be named like a secret
+// (secretConfigKey); TestConfigSecretsClassified fails otherwise.
+var publicConfigKeys = map[string]bool{
+	"ms_graph_tenant_id": true, "ms_graph_client_id": true, "ms_graph_email_from": true,
+	"fallback_email_from": true, "azure_cloud": true, "graph_base_url": true, "authority_host": true,
+	"graph_ca_file": true, "verify_mailbox": true, "startup_test_recipient": true,
+	"smtp_port": true, "smtp_host": true, "smtp_auth_username": true, "listeners": true,
+	"address": true, "tls": true, "auth_mechanisms": true, "tls_min_version": true, "tls_cipher_suites": true,
+	"default_subject": true, "from_display_name": true, "default_reply_to": true, "default_recipient": true,
+	"redirect_all_to": true, "daily_send_limit_file": true, "empty_body_policy": true,
+	"empty_body_placeholder": true, "malformed_mime_policy": true, "from_rewrite": true,
+	"sender_mailboxes": true, "send_from_allowlist": true, "allowed_recipient_domains": true,
+	"blocked_recipient_domains": true, "multiple_from_policy": true, "missing_from_policy": true,
+	"null_sender_policy": true, "preserve_auth_headers": true, "forward_headers": true,
+	"allowed_attachment_extensions": true, "blocked_attachment_extensions": true,
+	"archive_dir": true, "archive_mailbox": true, "archive_bcc": true, "delivery_mode": true,
+	"queue_dir": true, "deadletter_dir": true, "health_port": true, "health_path": true,
+	"ready_path": true, "log_level": true, "log_format": true, "log_output": true,
+	"trusted_proxy_header": true, "trusted_proxy_cidrs": true,
+}
+
+func TestConfigSecretsClassified(t *testing.T) {
+	var walk func(typ reflect.Type)
+	walk = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			key := field.Tag.Get("mapstructure")
+			ft := field.Type
+			if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct {
+				walk(ft.Elem())
+			}
+			switch ft.Kind() {
+			case reflect.String, reflect.Slice, reflect.Map:
+			default:
+				continue
+			}
+			secret := isSecretConfig(key, ft.Kind())
+			assert.True(t, secret || publicConfigKeys[key],
+				"config key %q is neither named like a secret nor listed in publicConfigKeys", key)
+			assert.False(t, secret && publicConfigKeys[key], "config key %q is listed as public but redacted", key)
+		}
+	}
+	walk(reflect.TypeOf(Config{}))
+
+	for _, key := range []string{"ms_graph_cert_pass", "ms_graph_cert_base64", "ms_graph_key_pem",
+		"graph_proxy", "smtp_auth_password", "api_key", "tls_key_file", "health_tls_cert", "presend_webhook_url"} {
+		assert.True(t, isSecretConfig(key, reflect.String), key)
+	}
+	assert.False(t, isSecretConfig("cert_expiry_warn_days", reflect.Int))
+}
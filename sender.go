@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// MailSender delivers a built Graph message as the given mailbox. The Graph
+// client implements it in production; tests inject a fake.
+type MailSender interface {
+	Send(ctx context.Context, mailbox string, msg models.Messageable) error
+}
+
+// MIMESender is implemented by senders that can also send a raw MIME
+// message, which is how a message gets a text alternative
+// (generate_text_alternative).
+type MIMESender interface {
+	SendMIME(ctx context.Context, mailbox string, mime []byte) error
+}
+
+// graphSender sends through Graph's sendMail action.
+type graphSender struct {
+	client *msgraphsdk.GraphServiceClient
+}
+
+func (g *graphSender) Send(ctx context.Context, mailbox string, msg models.Messageable) error {
+	requestBody := users.NewItemSendMailPostRequestBody()
+	requestBody.SetMessage(msg)
+	saveToSentItems := true
+	requestBody.SetSaveToSentItems(&saveToSentItems)
+
+	return g.client.Users().
+		ByUserId(mailbox).
+		SendMail().
+		Post(ctx, requestBody, nil)
+}
+
+// SendMIME posts mime to sendMail. Graph takes MIME as base64 text in a
+// text/plain body, and saves it to Sent Items like a JSON send.
+func (g *graphSender) SendMIME(ctx context.Context, mailbox string, mime []byte) error {
+	info := abstractions.NewRequestInformationWithMethodAndUrlTemplateAndPathParameters(
+		abstractions.POST, "{+baseurl}/users/{user%2Did}/sendMail", map[string]string{"user%2Did": mailbox})
+	info.Headers.TryAdd("Accept", "application/json")
+	info.SetStreamContentAndContentType([]byte(base64.StdEncoding.EncodeToString(mime)), "text/plain")
+	return g.client.GetAdapter().SendNoContent(ctx, info, abstractions.ErrorMappings{
+		"XXX": odataerrors.CreateODataErrorFromDiscriminatorValue,
+	})
+}
+
+// errMailboxLookupDenied means the app may not read users, so
+// verify_mailbox cannot tell whether the mailbox exists.
+var errMailboxLookupDenied = errors.New("not permitted to read users (grant User.Read.All or set verify_mailbox to off)")
+
+// verifyMailbox checks that mailbox is an existing, mail-enabled user, so
+// a typo in ms_graph_email_from shows up at startup rather than on the
+// first send. The account itself may be disabled: that is normal for
+// shared mailboxes, which can still send.
+func (g *graphSender) verifyMailbox(ctx context.Context, mailbox string) error {
+	user, err := g.client.Users().ByUserId(mailbox).Get(ctx, &users.UserItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.UserItemRequestBuilderGetQueryParameters{
+			Select: []string{"id", "mail"},
+		},
+	})
+	if err != nil {
+		ge := classifyGraphError(err)
+		switch {
+		case ge.Status == 403:
+			return errMailboxLookupDenied
+		case ge.Status == 404:
+			return fmt.Errorf("mailbox %s does not exist", mailbox)
+		}
+		return fmt.Errorf("failed to look up mailbox %s: %w", mailbox, ge)
+	}
+	if mail := user.GetMail(); mail == nil || *mail == "" {
+		return fmt.Errorf("%s has no mailbox (the user is not mail-enabled or not licensed for Exchange Online)", mailbox)
+	}
+	return nil
+}
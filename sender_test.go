@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphSender_VerifyMailbox(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch strings.TrimPrefix(r.URL.Path, "/v1.0/users/") {
+		case "ok@example.com":
+			io.WriteString(w, `{"id": "1", "mail": "ok@example.com", "accountEnabled": true}`)
+		case "nomail@example.com":
+			io.WriteString(w, `{"id": "2", "mail": null, "accountEnabled": true}`)
+		case "shared@example.com":
+			io.WriteString(w, `{"id": "3", "mail": "shared@example.com", "accountEnabled": false}`)
+		case "denied@example.com":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"error": {"code": "Authorization_RequestDenied", "message": "Insufficient privileges"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error": {"code": "Request_ResourceNotFound", "message": "Resource does not exist"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := msgraphsdk.NewGraphServiceClientWithCredentialsAndHosts(&fakeCredential{}, nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	client.GetAdapter().SetBaseUrl(srv.URL + "/v1.0")
+	g := &graphSender{client: client}
+	ctx := context.Background()
+
+	assert.NoError(t, g.verifyMailbox(ctx, "ok@example.com"))
+	assert.ErrorContains(t, g.verifyMailbox(ctx, "typo@example.com"), "does not exist")
+	assert.ErrorContains(t, g.verifyMailbox(ctx, "nomail@example.com"), "not mail-enabled")
+	assert.NoError(t, g.verifyMailbox(ctx, "shared@example.com"), "shared mailboxes have a disabled account")
+	assert.ErrorIs(t, g.verifyMailbox(ctx, "denied@example.com"), errMailboxLookupDenied)
+}
+
+func TestGraphSender_SendMIME(t *testing.T) {
+	var path, contentType string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		reader := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" { // the SDK compresses request bodies
+			reader, _ = gzip.NewReader(r.Body)
+		}
+		body, _ = io.ReadAll(reader)
+		if strings.Contains(path, "gone@example.com") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error": {"code": "ErrorInvalidUser", "message": "The requested user is invalid"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	client, err := msgraphsdk.NewGraphServiceClientWithCredentialsAndHosts(&fakeCredential{}, nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	client.GetAdapter().SetBaseUrl(srv.URL + "/v1.0")
+	g := &graphSender{client: client}
+
+	mime := []byte("Subject: hi\r\n\r\nhello\r\n")
+	require.NoError(t, g.SendMIME(context.Background(), "bridge@example.com", mime))
+	assert.Equal(t, "/v1.0/users/bridge@example.com/sendMail", path)
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mime), string(body))
+
+	err = g.SendMIME(context.Background(), "gone@example.com", mime)
+	assert.Equal(t, 404, classifyGraphError(err).Status)
+}
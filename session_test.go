@@ -0,0 +1,1343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer runs an SMTP server for b on a random local port and
+// returns its address.
+func startTestServer(t *testing.T, b *Backend) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := newSMTPServer(b)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestSession_RequireAuth(t *testing.T) {
+	b := newTestBackend(&Config{
+		RequireAuth:       true,
+		AuthUsername:      "user",
+		AuthPassword:      "pass",
+		AuthMechanisms:    []string{sasl.Plain},
+		AllowInsecureAuth: true,
+	})
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Mail("sender@example.com", nil), &smtpErr, "MAIL must be refused before AUTH")
+	assert.Equal(t, 530, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 0}, smtpErr.EnhancedCode)
+	require.ErrorAs(t, c.Auth(sasl.NewPlainClient("", "user", "wrong")), &smtpErr)
+	assert.Equal(t, 535, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 8}, smtpErr.EnhancedCode)
+	require.NoError(t, c.Auth(sasl.NewPlainClient("", "user", "pass")))
+	assert.NoError(t, c.Mail("sender@example.com", nil))
+}
+
+func TestSession_RequireValidHELO(t *testing.T) {
+	b := newTestBackend(&Config{RequireValidHELO: true})
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Hello("localhost"), &smtpErr)
+	assert.Equal(t, 501, smtpErr.Code)
+	c.Close()
+
+	c, err = smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example.com"))
+	assert.NoError(t, c.Mail("sender@example.com", nil))
+	c.Close()
+
+	// With the exemption, the client may authenticate first
+	b = newTestBackend(&Config{
+		RequireValidHELO:        true,
+		HELOExemptAuthenticated: true,
+		AuthUsername:            "user",
+		AuthPassword:            "pass",
+		AuthMechanisms:          []string{sasl.Plain},
+		AllowInsecureAuth:       true,
+	})
+	c, err = smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("printer"))
+	require.ErrorAs(t, c.Mail("sender@example.com", nil), &smtpErr)
+	assert.Equal(t, 501, smtpErr.Code)
+	require.NoError(t, c.Auth(sasl.NewPlainClient("", "user", "pass")))
+	assert.NoError(t, c.Mail("sender@example.com", nil))
+}
+
+func TestSession_MaxSessionsPerIP(t *testing.T) {
+	b := newTestBackend(&Config{MaxSessionsPerIP: 2})
+	addr := startTestServer(t, b)
+
+	dial := func() (*smtp.Client, error) {
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c, c.Hello("client.example.com")
+	}
+	// The first session sends EHLO twice; that doesn't take another slot
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	first := textproto.NewConn(conn)
+	_, _, err = first.ReadResponse(220)
+	require.NoError(t, err)
+	for range 2 {
+		require.NoError(t, first.PrintfLine("EHLO client.example.com"))
+		_, _, err = first.ReadResponse(250)
+		require.NoError(t, err)
+	}
+	_, err = dial()
+	require.NoError(t, err)
+
+	_, err = dial()
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 421, smtpErr.Code)
+
+	// Ending a session frees its slot
+	require.NoError(t, first.PrintfLine("QUIT"))
+	_, _, err = first.ReadResponse(221)
+	require.NoError(t, err)
+	// The server closes the connection after Logout
+	_, err = first.ReadLine()
+	require.ErrorIs(t, err, io.EOF)
+	first.Close()
+	_, err = dial()
+	assert.NoError(t, err)
+}
+
+func TestSession_Tarpit(t *testing.T) {
+	// commands returns how long RCPT, the second counted command, took
+	commands := func(auth bool) time.Duration {
+		b := newTestBackend(&Config{
+			MaxCommandsPerMinute: 1,
+			AuthUsername:         "user",
+			AuthPassword:         "pass",
+			AuthMechanisms:       []string{sasl.Plain},
+			AllowInsecureAuth:    true,
+		})
+		c, err := smtp.Dial(startTestServer(t, b))
+		require.NoError(t, err)
+		defer c.Close()
+		if auth {
+			require.NoError(t, c.Auth(sasl.NewPlainClient("", "user", "pass")))
+		}
+		require.NoError(t, c.Mail("sender@example.com", nil))
+		start := time.Now()
+		require.NoError(t, c.Rcpt("user@example.com", nil))
+		return time.Since(start)
+	}
+
+	assert.GreaterOrEqual(t, commands(false), time.Second, "one command over the limit waits a second")
+	assert.Less(t, commands(true), time.Second, "authenticated sessions are exempt")
+}
+
+func TestSession_GreetingDelay(t *testing.T) {
+	b := newTestBackend(&Config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := newSMTPServer(b)
+	go server.Serve(&greetingDelayListener{Listener: ln, delay: 200 * time.Millisecond})
+	t.Cleanup(func() { server.Close() })
+
+	start := time.Now()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	_, _, err = text.ReadResponse(220)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// Only the greeting is held back
+	start = time.Now()
+	require.NoError(t, text.PrintfLine("NOOP"))
+	_, _, err = text.ReadResponse(250)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestSession_SMTPUTF8Recipient(t *testing.T) {
+	b := newTestBackend(&Config{AllowedRecipientDomains: []string{"münchen.example"}})
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example"))
+	ok, _ := c.Extension("SMTPUTF8")
+	assert.True(t, ok, "SMTPUTF8 must be advertised")
+
+	require.NoError(t, c.Mail("absender@bücher.example", &smtp.MailOptions{UTF8: true}))
+	assert.NoError(t, c.Rcpt("jürgen@münchen.example", nil))
+
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Rcpt("user@other.example", nil), &smtpErr)
+	assert.Equal(t, 550, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 1}, smtpErr.EnhancedCode)
+
+	recipients := buildRecipients([]string{"jürgen@münchen.example"})
+	assert.Equal(t, "jürgen@münchen.example", *recipients[0].GetEmailAddress().GetAddress())
+}
+
+func TestSession_DistributionListRecipient(t *testing.T) {
+	b := newTestBackend(&Config{})
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	assert.NoError(t, c.Rcpt("all-staff@example.com", nil))
+
+	// The list goes to Graph as one recipient, not expanded
+	msg := buildGraphMessage("bridge@example.com", &outgoingMessage{To: []string{"all-staff@example.com"}})
+	require.Len(t, msg.GetToRecipients(), 1)
+	assert.Equal(t, "all-staff@example.com", *msg.GetToRecipients()[0].GetEmailAddress().GetAddress())
+}
+
+func TestSession_AuthMechanisms(t *testing.T) {
+	// Without TLS, AUTH is refused unless explicitly allowed
+	b := newTestBackend(&Config{AuthMechanisms: []string{sasl.Plain}, AuthUsername: "user", AuthPassword: "pass"})
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client.example"))
+	ok, _ := c.Extension("AUTH")
+	assert.False(t, ok, "AUTH must not be advertised without TLS")
+
+	// Only configured mechanisms are offered and accepted
+	b = newTestBackend(&Config{AuthMechanisms: []string{sasl.Login}, AllowInsecureAuth: true, AuthUsername: "user", AuthPassword: "pass"})
+	c, err = smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client.example"))
+	_, mechs := c.Extension("AUTH")
+	assert.Equal(t, "LOGIN", mechs)
+	assert.Error(t, c.Auth(sasl.NewPlainClient("", "user", "pass")))
+}
+
+func TestSession_AcceptModeQueues(t *testing.T) {
+	config := &Config{DeliveryMode: "accept", QueueMaxRetries: 3}
+	b := newTestBackend(config)
+	var err error
+	b.queue, err = newRetryQueue(config, b)
+	require.NoError(t, err)
+
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	require.NoError(t, c.Rcpt("user@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: queued\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close(), "accept mode must answer 250 without calling Graph")
+
+	b.queue.mu.Lock()
+	defer b.queue.mu.Unlock()
+	require.Len(t, b.queue.items, 1)
+	for _, item := range b.queue.items {
+		assert.Equal(t, "queued", item.Message.Subject)
+		assert.Equal(t, []string{"user@example.com"}, item.Message.To)
+	}
+}
+
+func TestSession_AdvertisesSize(t *testing.T) {
+	b := newTestBackend(&Config{MaxMessageBytes: 5 * 1024 * 1024})
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example"))
+	ok, size := c.Extension("SIZE")
+	assert.True(t, ok)
+	assert.Equal(t, "5242880", size)
+}
+
+// sendTestMessage runs one SMTP transaction against addr and returns the
+// error from finishing DATA.
+func sendTestMessage(t *testing.T, addr, rcpt, data string) error {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	require.NoError(t, c.Rcpt(rcpt, nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+	return w.Close()
+}
+
+func TestSession_EmptyBody(t *testing.T) {
+	headersOnly := "From: app@example.com\r\nSubject: no body\r\n\r\n"
+
+	config := &Config{EmptyBodyPolicy: "reject"}
+	err := sendTestMessage(t, startTestServer(t, newTestBackend(config)), "user@example.com", headersOnly)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 554, smtpErr.Code)
+
+	// "allow" substitutes the placeholder; use accept mode to inspect the result
+	config = &Config{EmptyBodyPolicy: "allow", EmptyBodyPlaceholder: "(empty)", DeliveryMode: "accept", QueueMaxRetries: 1}
+	b := newTestBackend(config)
+	b.queue, err = newRetryQueue(config, b)
+	require.NoError(t, err)
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", headersOnly))
+	require.Len(t, b.queue.items, 1)
+	for _, item := range b.queue.items {
+		assert.Equal(t, "(empty)", item.Message.Body)
+	}
+}
+
+func TestSession_MaintenanceMode(t *testing.T) {
+	b := newTestBackend(&Config{})
+	b.setMaintenance(true)
+
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Mail("sender@example.com", nil), &smtpErr)
+	assert.Equal(t, 421, smtpErr.Code)
+}
+
+func TestSession_PartSizeLimit(t *testing.T) {
+	b := newTestBackend(&Config{MaxPartBytes: 1024, EmptyBodyPolicy: "allow"})
+	msg := "Subject: big\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat(strings.Repeat("a", 70)+"\r\n", 30) + "--XX--\r\n"
+
+	err := sendTestMessage(t, startTestServer(t, b), "user@example.com", msg)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+}
+
+// endlessReader never runs out, so reading it whole never returns.
+type endlessReader struct{ read int64 }
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestReadPart_StopsAtLimit(t *testing.T) {
+	r := &endlessReader{}
+	_, err := readPart(r, 1024)
+	assert.ErrorIs(t, err, errPartLimit)
+	assert.Equal(t, int64(1025), r.read, "reads stop one byte past the limit")
+}
+
+// lockedBuffer is a bytes.Buffer safe for the server goroutine to log into.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSession_LogsCarrySessionID(t *testing.T) {
+	var logs lockedBuffer
+	b := newTestBackend(&Config{RequireAuth: true})
+	b.logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	addr := startTestServer(t, b)
+
+	for range 2 {
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+		c.Mail("sender@example.com", nil)
+		require.NoError(t, c.Quit())
+	}
+
+	require.Eventually(t, func() bool { return strings.Count(logs.String(), "Session closed") == 2 }, time.Second, 10*time.Millisecond)
+	ids := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		id, _ := entry["session_id"].(string)
+		require.NotEmpty(t, id, line)
+		ids[id]++
+	}
+	assert.Len(t, ids, 2, "each session gets its own ID")
+}
+
+func TestSession_ForwardedMessageAttached(t *testing.T) {
+	config := &Config{DeliveryMode: "accept", QueueMaxRetries: 1}
+	b := newTestBackend(config)
+	var err error
+	b.queue, err = newRetryQueue(config, b)
+	require.NoError(t, err)
+
+	nested := "From: original@example.com\r\nSubject: original\r\n\r\nforwarded body\r\n"
+	msg := "Subject: Fwd: original\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nsee below\r\n" +
+		"--XX\r\nContent-Type: message/rfc822\r\n\r\n" + nested +
+		"--XX--\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	require.Len(t, b.queue.items, 1)
+	for _, item := range b.queue.items {
+		assert.Equal(t, "see below", strings.TrimSpace(item.Message.Body), "the nested message must not replace the body")
+		require.Len(t, item.Message.Attachments, 1)
+		att := item.Message.Attachments[0]
+		assert.Equal(t, "forwarded.eml", att.Name)
+		assert.Equal(t, "message/rfc822", att.ContentType)
+		assert.Contains(t, string(att.Content), "forwarded body")
+	}
+}
+
+// fakeSender records messages instead of calling Graph.
+type fakeSender struct {
+	mu       sync.Mutex
+	mailbox  string
+	messages []models.Messageable
+	err      error
+}
+
+func (f *fakeSender) Send(ctx context.Context, mailbox string, msg models.Messageable) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mailbox = mailbox
+	f.messages = append(f.messages, msg)
+	return f.err
+}
+
+func TestSession_ParseAndSend(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+
+	msg := "From: App <app@example.com>\r\nTo: user@example.com\r\nSubject: Hello\r\n" +
+		"Content-Type: multipart/alternative; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--XX\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n" +
+		"--XX--\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	require.Len(t, sender.messages, 1)
+	sent := sender.messages[0]
+	assert.Equal(t, "bridge@example.com", sender.mailbox)
+	assert.Equal(t, "Hello", *sent.GetSubject())
+	assert.Equal(t, models.HTML_BODYTYPE, *sent.GetBody().GetContentType())
+	assert.Equal(t, "<p>hi</p>", strings.TrimSpace(*sent.GetBody().GetContent()))
+	assert.Equal(t, "App", *sent.GetFrom().GetEmailAddress().GetName())
+	require.Len(t, sent.GetToRecipients(), 1)
+	assert.Equal(t, "user@example.com", *sent.GetToRecipients()[0].GetEmailAddress().GetAddress())
+
+	// Graph errors are classified into SMTP replies
+	sender.err = newODataError(400, "ErrorInvalidRecipients")
+	err := sendTestMessage(t, startTestServer(t, b), "user@example.com", msg)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 550, smtpErr.Code)
+}
+
+// mimeSender is a fakeSender that also takes raw MIME sends.
+type mimeSender struct {
+	fakeSender
+	mime [][]byte
+}
+
+func (f *mimeSender) SendMIME(ctx context.Context, mailbox string, mime []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mailbox = mailbox
+	f.mime = append(f.mime, mime)
+	return f.err
+}
+
+func TestSession_GenerateTextAlternative(t *testing.T) {
+	sender := &mimeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, GenerateTextAlternative: true})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	html := "From: App <app@example.com>\r\nTo: user@example.com\r\nSubject: Invoice\r\n" +
+		"Content-Type: text/html\r\n\r\n" +
+		"<p>Your invoice: <a href=\"https://billing.example.com/inv/7\">view</a></p>\r\n"
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", html))
+
+	require.Len(t, sender.mime, 1)
+	assert.Empty(t, sender.messages)
+	mr, err := mail.CreateReader(bytes.NewReader(sender.mime[0]))
+	require.NoError(t, err)
+	mediaType, _, err := mr.Header.ContentType()
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	subject, _ := mr.Header.Subject()
+	assert.Equal(t, "Invoice", subject)
+	to, _ := mr.Header.AddressList("To")
+	require.Len(t, to, 1)
+	assert.Equal(t, "user@example.com", to[0].Address)
+
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		ct, _, _ := p.Header.(*mail.InlineHeader).ContentType()
+		body, _ := io.ReadAll(p.Body)
+		parts = append(parts, ct+": "+strings.TrimSpace(string(body)))
+	}
+	require.Len(t, parts, 2)
+	assert.Equal(t, "text/plain: Your invoice: view (https://billing.example.com/inv/7)", parts[0])
+	assert.True(t, strings.HasPrefix(parts[1], "text/html: <p>Your invoice"))
+
+	// Plain-text messages, and those with Graph-only properties, stay JSON
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nhi\r\n"))
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "X-MS-Categories: Billing\r\n"+html))
+	assert.Len(t, sender.mime, 1)
+	assert.Len(t, sender.messages, 2)
+}
+
+func TestSession_ParseVersusSendErrors(t *testing.T) {
+	sender := &fakeSender{err: newODataError(503, "ServiceUnavailable")}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, MalformedMIMEPolicy: "reject"})
+	b.sender = sender
+	addr := startTestServer(t, b)
+	parseErrors, sendErrors := metrics.Get("parse_errors_total"), metrics.Get("send_errors_total")
+
+	// Closing boundary missing: the client's fault, never reaches Graph
+	truncated := "Subject: x\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nhi\r\n"
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", truncated), &smtpErr)
+	assert.Equal(t, 554, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 6, 0}, smtpErr.EnhancedCode)
+	assert.Equal(t, parseErrors+1, metrics.Get("parse_errors_total"))
+	assert.Equal(t, sendErrors, metrics.Get("send_errors_total"))
+	assert.Empty(t, sender.messages)
+
+	// Graph outage: temporary, counted as a send error
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nhi\r\n"), &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Equal(t, parseErrors+1, metrics.Get("parse_errors_total"))
+	assert.Equal(t, sendErrors+1, metrics.Get("send_errors_total"))
+}
+
+func TestSession_PacingBacklog(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, MailboxSendRate: 1})
+	b.pacer = newSendPacer(1)
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nfirst\r\n"))
+
+	// The next slot is a minute out: answered at once instead of held
+	start := time.Now()
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nsecond\r\n"), &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Less(t, time.Since(start), maxPacingDelay)
+	assert.Len(t, sender.messages, 1)
+}
+
+// mailboxSender fails sends from the mailboxes in fail.
+type mailboxSender struct {
+	mu        sync.Mutex
+	fail      map[string]error
+	mailboxes []string
+}
+
+func (f *mailboxSender) Send(ctx context.Context, mailbox string, msg models.Messageable) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mailboxes = append(f.mailboxes, mailbox)
+	return f.fail[mailbox]
+}
+
+func TestSession_FallbackEmailFrom(t *testing.T) {
+	sender := &mailboxSender{fail: map[string]error{
+		"bridge@example.com": newODataError(400, "MailboxNotEnabledForRESTAPI"),
+	}}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, FallbackEmailFrom: "fallback@example.com"})
+	b.sender = sender
+	b.quota, _ = newSendQuota(10, "", b.logger)
+	b.breaker = newCircuitBreaker(2, time.Minute, b.logger)
+	addr := startTestServer(t, b)
+
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nhi\r\n"))
+	assert.Equal(t, []string{"bridge@example.com", "fallback@example.com"}, sender.mailboxes)
+	assert.Zero(t, b.quota.state.Counts["bridge@example.com"], "the failed attempt gives its slot back")
+	assert.Equal(t, 1, b.quota.state.Counts["fallback@example.com"])
+
+	// A failing fallback is one breaker failure, not two
+	sender.fail["fallback@example.com"] = newODataError(503, "ServiceUnavailable")
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nhi\r\n"), &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Len(t, sender.mailboxes, 4)
+	assert.Equal(t, 1, b.breaker.failures)
+	assert.Equal(t, circuitClosed, b.breaker.state)
+	assert.Equal(t, 1, b.quota.state.Counts["fallback@example.com"])
+}
+
+func TestSession_DefaultReplyTo(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, DefaultReplyTo: "helpdesk@contoso.com", ArchiveBcc: "archive@contoso.com"})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "Subject: x\r\n\r\nhi\r\n"))
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "Reply-To: app@example.com\r\nSubject: x\r\n\r\nhi\r\n"))
+
+	require.Len(t, sender.messages, 2)
+	replyTo := func(i int) string {
+		return *sender.messages[i].GetReplyTo()[0].GetEmailAddress().GetAddress()
+	}
+	assert.Equal(t, "helpdesk@contoso.com", replyTo(0))
+	assert.Equal(t, "app@example.com", replyTo(1), "the client's Reply-To wins")
+
+	// The caller's message is left alone, so a queued copy isn't changed
+	msg := &outgoingMessage{To: []string{"user@example.com"}, Body: "hi", ContentType: "text"}
+	require.NoError(t, batchesError(b.sendBatches("bridge@example.com", msg)))
+	assert.Empty(t, msg.ReplyTo)
+	assert.Empty(t, msg.ArchiveBcc)
+	assert.Equal(t, "helpdesk@contoso.com", *sender.messages[2].GetReplyTo()[0].GetEmailAddress().GetAddress())
+}
+
+func TestSession_MalformedMIMEDelivered(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, MalformedMIMEPolicy: "deliver"})
+	b.sender = sender
+	parseErrors := metrics.Get("parse_errors_total")
+
+	// The default: the parts read before the cut-off are sent
+	truncated := "Subject: x\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nfirst line\r\nsecond line\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", truncated))
+
+	require.Len(t, sender.messages, 1)
+	assert.Contains(t, *sender.messages[0].GetBody().GetContent(), "first line")
+	assert.Equal(t, parseErrors+1, metrics.Get("parse_errors_total"))
+}
+
+func TestSession_ForcePlainText(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, ForcePlainText: true})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	alternative := "Subject: x\r\nContent-Type: multipart/alternative; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nplain version\r\n" +
+		"--XX\r\nContent-Type: text/html\r\n\r\n<p>html version</p>\r\n" +
+		"--XX--\r\n"
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", alternative))
+	htmlOnly := "Subject: x\r\nContent-Type: text/html\r\n\r\n<p>Hello <b>there</b></p>\r\n"
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", htmlOnly))
+
+	// Per message, through the control header
+	b.config.ForcePlainText = false
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", "X-Force-Plain-Text: yes\r\n"+htmlOnly))
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", htmlOnly))
+
+	require.Len(t, sender.messages, 4)
+	for i, want := range []string{"plain version", "Hello there", "Hello there"} {
+		body := sender.messages[i].GetBody()
+		assert.Equal(t, models.TEXT_BODYTYPE, *body.GetContentType())
+		assert.Equal(t, want, strings.TrimSpace(*body.GetContent()))
+	}
+	assert.Equal(t, models.HTML_BODYTYPE, *sender.messages[3].GetBody().GetContentType())
+}
+
+func TestSession_AuthHeaders(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, PreserveAuthHeaders: []string{"Authentication-Results"}})
+	b.sender = sender
+
+	msg := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=app; h=from:subject; bh=abc=; b=def=\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.com\r\n" +
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.com; s=arc; b=ghi=\r\n" +
+		"From: app@example.com\r\nSubject: signed\r\n\r\nhello\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	require.Len(t, sender.messages, 1)
+	props := map[string]string{}
+	for _, p := range sender.messages[0].GetSingleValueExtendedProperties() {
+		props[*p.GetId()] = *p.GetValue()
+	}
+	assert.Equal(t, "mx.example.com; spf=pass smtp.mailfrom=example.com", props[internetHeaderProp("Authentication-Results")])
+	assert.NotContains(t, props, internetHeaderProp("ARC-Seal"), "not opted in")
+	assert.NotContains(t, props, internetHeaderProp("DKIM-Signature"))
+	for _, h := range sender.messages[0].GetInternetMessageHeaders() {
+		assert.NotEqual(t, "DKIM-Signature", *h.GetName())
+	}
+}
+
+func TestSession_ForwardHeaders(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, ForwardHeaders: []string{"List-Unsubscribe", "X-Ticket-Id"}})
+	b.sender = sender
+
+	msg := "From: app@example.com\r\nTo: user@example.com\r\nBcc: hidden@example.com\r\n" +
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>,\r\n <https://example.com/unsubscribe>\r\n" +
+		"X-Ticket-Id: 4711\r\nX-Internal-Trace: host=build-07\r\nSubject: forwarded\r\n\r\nhello\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	require.Len(t, sender.messages, 1)
+	props := map[string]string{}
+	for _, p := range sender.messages[0].GetSingleValueExtendedProperties() {
+		props[*p.GetId()] = *p.GetValue()
+	}
+	assert.Equal(t, "<mailto:unsubscribe@example.com>, <https://example.com/unsubscribe>", props[internetHeaderProp("List-Unsubscribe")])
+	assert.NotContains(t, props, internetHeaderProp("Bcc"))
+
+	headers := map[string]string{}
+	for _, h := range sender.messages[0].GetInternetMessageHeaders() {
+		headers[*h.GetName()] = *h.GetValue()
+	}
+	assert.Equal(t, "4711", headers["X-Ticket-Id"])
+	assert.NotContains(t, headers, "X-Internal-Trace", "not in the allowlist")
+	assert.Contains(t, headers, "X-Original-Date")
+}
+
+func TestSession_8BitMIME(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example"))
+	ok, _ := c.Extension("8BITMIME")
+	assert.True(t, ok, "8BITMIME must be advertised")
+
+	body := "Grüße aus München – 日本語テキスト 🚀"
+	require.NoError(t, c.Mail("sender@example.com", &smtp.MailOptions{Body: smtp.Body8BitMIME}))
+	require.NoError(t, c.Rcpt("user@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: 8bit\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" + body + "\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, body, strings.TrimSpace(*sender.messages[0].GetBody().GetContent()))
+}
+
+func TestSession_ArchiveRaw(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestBackend(&Config{GraphTimeout: time.Second, ArchiveDir: dir})
+	b.sender = &fakeSender{}
+
+	msg := "Subject: keep me\r\nX-Custom: exact\r\n\r\nbody\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(data))
+}
+
+func TestSession_ArchiveMailbox(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, ArchiveDir: dir, ArchiveMailbox: "archive@contoso.com", MissingFromPolicy: "reject"})
+	b.sender = sender
+	addr := startTestServer(t, b)
+	wait := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		require.NoError(t, b.waitBackground(ctx))
+	}
+
+	msg := "From: app@example.com\r\nSubject: keep me\r\n\r\nbody\r\n"
+	require.NoError(t, sendTestMessage(t, addr, "user@example.com", msg))
+	wait()
+	require.Len(t, sender.messages, 2)
+	var copy models.Messageable
+	for _, m := range sender.messages {
+		if *m.GetToRecipients()[0].GetEmailAddress().GetAddress() == "archive@contoso.com" {
+			copy = m
+		}
+	}
+	require.NotNil(t, copy, "archive copy sent")
+	require.Len(t, copy.GetAttachments(), 1)
+
+	// A rejected message is neither archived nor copied
+	sender.messages = nil
+	require.Error(t, sendTestMessage(t, addr, "user@example.com", "Subject: no from\r\n\r\nbody\r\n"))
+	wait()
+	assert.Empty(t, sender.messages)
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestSession_RcptBeforeMail(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example"))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Rcpt("user@example.com", nil), &smtpErr)
+	assert.Equal(t, smtp.EnhancedCode{5, 5, 1}, smtpErr.EnhancedCode, "out-of-order RCPT must be refused permanently")
+
+	// After RSET the session is back to needing MAIL FROM
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	require.NoError(t, c.Reset())
+	assert.Error(t, c.Rcpt("user@example.com", nil))
+	assert.Empty(t, sender.messages)
+
+	// The session enforces the order itself too
+	s := &Session{backend: b, logger: b.logger}
+	require.ErrorAs(t, s.Rcpt("user@example.com", nil), &smtpErr)
+	assert.Equal(t, 503, smtpErr.Code)
+	assert.Empty(t, s.to)
+}
+
+// DATA without any RCPT TO is refused by go-smtp before the session sees
+// the message, so recipients can't be taken from the headers instead.
+func TestSession_DataWithoutRcpt(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example"))
+	require.NoError(t, c.Mail("", nil))
+	_, err = c.Data()
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 502, smtpErr.Code)
+	assert.Empty(t, sender.messages)
+}
+
+func TestSession_EncodedSubject(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+
+	// Folded, base64-encoded UTF-8 subject, plus a windows-1252 body
+	msg := "From: =?windows-1252?Q?Ren=E9?= <app@example.com>\r\n" +
+		"Subject: =?UTF-8?B?U3RhdHVzYmVyaWNodDogR3LDtsOfZSDDnGJlcnNpY2h0?=\r\n =?UTF-8?B?IOKAkyDinJM=?=\r\n" +
+		"Content-Type: text/plain; charset=windows-1252\r\n\r\nPreis: 5 \x80\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg))
+
+	require.Len(t, sender.messages, 1)
+	sent := sender.messages[0]
+	assert.Equal(t, "Statusbericht: Größe Übersicht – ✓", *sent.GetSubject())
+	assert.Equal(t, "René", *sent.GetFrom().GetEmailAddress().GetName())
+	assert.Equal(t, "Preis: 5 €", strings.TrimSpace(*sent.GetBody().GetContent()))
+}
+
+// htmlRejectingSender refuses HTML bodies the way Graph refuses oversized
+// or malformed ones, and records what it accepted.
+type htmlRejectingSender struct {
+	fakeSender
+	attempts int
+}
+
+func (f *htmlRejectingSender) Send(ctx context.Context, mailbox string, msg models.Messageable) error {
+	f.attempts++
+	if *msg.GetBody().GetContentType() == models.HTML_BODYTYPE {
+		return newODataError(413, "RequestBodyTooLarge")
+	}
+	return f.fakeSender.Send(ctx, mailbox, msg)
+}
+
+func TestSession_HTMLTextFallback(t *testing.T) {
+	send := func(config *Config, msg string) (*htmlRejectingSender, error) {
+		sender := &htmlRejectingSender{}
+		b := newTestBackend(config)
+		b.sender = sender
+		return sender, sendTestMessage(t, startTestServer(t, b), "user@example.com", msg)
+	}
+	alternative := "Subject: report\r\nContent-Type: multipart/alternative; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nplain version\r\n" +
+		"--XX\r\nContent-Type: text/html\r\n\r\n<p>html version</p>\r\n" +
+		"--XX--\r\n"
+
+	sender, err := send(&Config{GraphTimeout: time.Second, HTMLTextFallback: true}, alternative)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sender.attempts)
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, models.TEXT_BODYTYPE, *sender.messages[0].GetBody().GetContentType())
+	assert.Equal(t, "plain version", strings.TrimSpace(*sender.messages[0].GetBody().GetContent()))
+
+	// HTML-only messages are converted
+	sender, err = send(&Config{GraphTimeout: time.Second, HTMLTextFallback: true},
+		"Subject: report\r\nContent-Type: text/html\r\n\r\n<p>only <b>html</b></p>\r\n")
+	require.NoError(t, err)
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "only html", *sender.messages[0].GetBody().GetContent())
+
+	sender, err = send(&Config{GraphTimeout: time.Second}, alternative)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Equal(t, 1, sender.attempts)
+
+	// Mostly attachment: a text resend would be just as large
+	withAttachment := "Subject: report\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/html\r\n\r\n<p>see attached</p>\r\n" +
+		"--XX\r\nContent-Type: message/rfc822\r\nContent-Disposition: attachment; filename=fwd.eml\r\n\r\n" +
+		"Subject: forwarded\r\n\r\n" + strings.Repeat("forwarded text\r\n", 100) +
+		"--XX--\r\n"
+	sender, err = send(&Config{GraphTimeout: time.Second, HTMLTextFallback: true}, withAttachment)
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Equal(t, 1, sender.attempts)
+}
+
+func TestSession_SendFromHeader(t *testing.T) {
+	var logs lockedBuffer
+	send := func(auth bool, sendFrom string) string {
+		sender := &fakeSender{}
+		b := newTestBackend(&Config{
+			GraphTimeout:      time.Second,
+			AuthUsername:      "user",
+			AuthPassword:      "pass",
+			AuthMechanisms:    []string{sasl.Plain},
+			AllowInsecureAuth: true,
+			SendFromAllowlist: []string{"team@contoso.com", "@apps.contoso.com"},
+		})
+		b.sender = sender
+		b.logger = slog.New(&redactingHandler{Handler: slog.NewTextHandler(&logs,
+			&slog.HandlerOptions{Level: slog.LevelDebug})})
+
+		c, err := smtp.Dial(startTestServer(t, b))
+		require.NoError(t, err)
+		defer c.Close()
+		if auth {
+			require.NoError(t, c.Auth(sasl.NewPlainClient("", "user", "pass")))
+		}
+		require.NoError(t, c.Mail("app@example.com", nil))
+		require.NoError(t, c.Rcpt("user@example.com", nil))
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, err = w.Write([]byte("X-Send-From: " + sendFrom + "\r\nSubject: hi\r\n\r\nbody\r\n"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return sender.mailbox
+	}
+
+	assert.Equal(t, "Team@Contoso.com", send(true, "Team <Team@Contoso.com>"))
+	assert.Equal(t, "billing@apps.contoso.com", send(true, "billing@apps.contoso.com"))
+	assert.Equal(t, "bridge@example.com", send(true, "ceo@contoso.com"), "not in the allowlist")
+	assert.Equal(t, "bridge@example.com", send(false, "team@contoso.com"), "unauthenticated")
+
+	out := logs.String()
+	assert.Contains(t, out, "X-Send-From")
+	for _, addr := range []string{"Team@Contoso.com", "team@contoso.com", "billing@", "ceo@", "bridge@"} {
+		assert.NotContains(t, out, addr, "X-Send-From logs are redacted")
+	}
+}
+
+func TestSession_NullSender(t *testing.T) {
+	send := func(policy string) (*fakeSender, error) {
+		sender := &fakeSender{}
+		b := newTestBackend(&Config{GraphTimeout: time.Second, NullSenderPolicy: policy})
+		b.sender = sender
+
+		c, err := smtp.Dial(startTestServer(t, b))
+		require.NoError(t, err)
+		defer c.Close()
+		if err := c.Mail("", nil); err != nil {
+			return sender, err
+		}
+		require.NoError(t, c.Rcpt("user@example.com", nil))
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, err = w.Write([]byte("Subject: Undeliverable\r\n\r\nbounce\r\n"))
+		require.NoError(t, err)
+		return sender, w.Close()
+	}
+
+	sender, err := send("accept")
+	require.NoError(t, err)
+	assert.Equal(t, "bridge@example.com", sender.mailbox)
+	assert.Len(t, sender.messages, 1)
+
+	sender, err = send("reject")
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 550, smtpErr.Code)
+	assert.Empty(t, sender.messages)
+}
+
+func TestSession_AttachmentRestrictions(t *testing.T) {
+	b := newTestBackend(&Config{
+		GraphTimeout:                time.Second,
+		MaxAttachmentBytes:          64,
+		BlockedAttachmentExtensions: []string{".exe", "js"},
+	})
+	b.sender = &fakeSender{}
+	addr := startTestServer(t, b)
+
+	withAttachment := func(name, content string) string {
+		return "Subject: files\r\nContent-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+			"--XX\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--XX\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"" + name + "\"\r\n\r\n" + content + "\r\n" +
+			"--XX--\r\n"
+	}
+
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", withAttachment("setup.EXE", "MZ")), &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	require.ErrorAs(t, sendTestMessage(t, addr, "user@example.com", withAttachment("report.txt", strings.Repeat("x", 100))), &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.NoError(t, sendTestMessage(t, addr, "user@example.com", withAttachment("report.txt", "small")))
+}
+
+func TestSession_BccHeaderStripped(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	require.NoError(t, c.Rcpt("visible@example.com", nil))
+	require.NoError(t, c.Rcpt("secret@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Bcc: secret@example.com\r\nSubject: hidden\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Len(t, sender.messages, 1)
+	sent := sender.messages[0]
+	for _, h := range sent.GetInternetMessageHeaders() {
+		assert.NotEqual(t, "bcc", strings.ToLower(*h.GetName()), "the Bcc header must not be passed on")
+	}
+	require.Len(t, sent.GetToRecipients(), 1)
+	assert.Equal(t, "visible@example.com", *sent.GetToRecipients()[0].GetEmailAddress().GetAddress())
+	require.Len(t, sent.GetBccRecipients(), 1, "Bcc recipients are still delivered")
+	assert.Equal(t, "secret@example.com", *sent.GetBccRecipients()[0].GetEmailAddress().GetAddress())
+}
+
+func TestSession_DeclaredSizeEnforced(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, MaxInflightBytes: defaultMaxMessageBytes})
+	b.budget = newMemoryBudget(b.config.MaxInflightBytes)
+	b.sender = sender
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client.example"))
+
+	// SIZE=100 reserves 100 bytes, so a longer message is refused
+	require.NoError(t, c.Mail("sender@example.com", &smtp.MailOptions{Size: 100}))
+	require.NoError(t, c.Rcpt("user@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	io.WriteString(w, "Subject: x\r\n\r\n"+strings.Repeat("long line of text\r\n", 100))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, w.Close(), &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 3, 4}, smtpErr.EnhancedCode)
+	assert.Empty(t, sender.messages)
+	assert.Zero(t, b.budget.used, "the reservation is released")
+
+	// The session carries on
+	require.NoError(t, c.Mail("sender@example.com", &smtp.MailOptions{Size: 100}))
+	require.NoError(t, c.Rcpt("user@example.com", nil))
+	w, err = c.Data()
+	require.NoError(t, err)
+	io.WriteString(w, "Subject: x\r\n\r\nshort\r\n")
+	require.NoError(t, w.Close())
+	assert.Len(t, sender.messages, 1)
+}
+
+func TestSession_IdleTimeout(t *testing.T) {
+	b := newTestBackend(&Config{IdleTimeout: 100 * time.Millisecond})
+	c, err := smtp.Dial(startTestServer(t, b))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client.example"))
+	require.NoError(t, c.Noop(), "activity within the timeout keeps the session open")
+
+	time.Sleep(300 * time.Millisecond)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, c.Noop(), &smtpErr)
+	assert.Equal(t, 421, smtpErr.Code)
+}
+
+func TestSession_TruncatedData(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = sender
+	addr := startTestServer(t, b)
+	before := metrics.Get("data_incomplete_total")
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	text := textproto.NewConn(conn)
+	expect := func(code int) {
+		t.Helper()
+		_, _, err := text.ReadResponse(code)
+		require.NoError(t, err)
+	}
+	expect(220)
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<app@example.com>", 250},
+		{"RCPT TO:<user@example.com>", 250},
+		{"DATA", 354},
+	} {
+		require.NoError(t, text.PrintfLine("%s", cmd.line))
+		expect(cmd.code)
+	}
+	// Half a message and no terminating dot
+	require.NoError(t, text.PrintfLine("Subject: report\r\n\r\nFirst half of the bo"))
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		return metrics.Get("data_incomplete_total") == before+1
+	}, 2*time.Second, 10*time.Millisecond)
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	assert.Empty(t, sender.messages)
+}
+
+func TestSession_DataReadError(t *testing.T) {
+	b := newTestBackend(&Config{GraphTimeout: time.Second})
+	b.sender = &fakeSender{}
+	s := &Session{backend: b, logger: b.logger, to: []string{"user@example.com"}}
+
+	r := io.MultiReader(strings.NewReader("Subject: x\r\n\r\nhal"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	assert.Equal(t, errIncompleteData, s.Data(r))
+	assert.Equal(t, errReadFailed, s.Data(iotest.ErrReader(errors.New("read failed"))))
+}
+
+func TestSession_ArchiveBcc(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, RecipientBatchSize: 2, ArchiveBcc: "archive@contoso.com"})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("app@example.com", nil))
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		require.NoError(t, c.Rcpt(rcpt, nil))
+	}
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("To: a@example.com, b@example.com, c@example.com\r\nSubject: report\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// One archive copy per batch, hidden from the recipients
+	require.Len(t, sender.messages, 2)
+	for _, msg := range sender.messages {
+		require.Len(t, msg.GetBccRecipients(), 1)
+		assert.Equal(t, "archive@contoso.com", *msg.GetBccRecipients()[0].GetEmailAddress().GetAddress())
+		for _, r := range msg.GetToRecipients() {
+			assert.NotEqual(t, "archive@contoso.com", *r.GetEmailAddress().GetAddress())
+		}
+	}
+	assert.Len(t, sender.messages[0].GetToRecipients(), 2)
+	assert.Len(t, sender.messages[1].GetToRecipients(), 1)
+
+	// A client that already addresses the archive isn't sent a second copy
+	sender.messages = nil
+	require.NoError(t, sendTestMessage(t, addr, "Archive@contoso.com", "Subject: x\r\n\r\nbody\r\n"))
+	require.Len(t, sender.messages, 1)
+	assert.Empty(t, sender.messages[0].GetBccRecipients())
+	assert.Len(t, sender.messages[0].GetToRecipients(), 1)
+}
+
+func TestSession_ResentHeaders(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{
+		GraphTimeout:    time.Second,
+		SendOnBehalf:    true,
+		SenderMailboxes: map[string]string{"branda.com": "shared-a@contoso.com"},
+	})
+	b.sender = sender
+
+	// Forwarded by helpdesk@branda.com to ops; the original To is history
+	msg := "Resent-From: Helpdesk <helpdesk@branda.com>\r\n" +
+		"Resent-To: ops@example.com\r\n" +
+		"Resent-Date: Mon, 12 Oct 2026 09:00:00 +0000\r\n" +
+		"From: Customer <customer@example.net>\r\n" +
+		"To: helpdesk@branda.com\r\n" +
+		"Subject: printer on fire\r\n\r\nbody\r\n"
+	require.NoError(t, sendTestMessage(t, startTestServer(t, b), "ops@example.com", msg))
+
+	require.Len(t, sender.messages, 1)
+	sent := sender.messages[0]
+	assert.Equal(t, "shared-a@contoso.com", sender.mailbox)
+	assert.Equal(t, "helpdesk@branda.com", *sent.GetFrom().GetEmailAddress().GetAddress())
+	require.Len(t, sent.GetToRecipients(), 1)
+	assert.Equal(t, "ops@example.com", *sent.GetToRecipients()[0].GetEmailAddress().GetAddress())
+	assert.Empty(t, sent.GetBccRecipients())
+}
+
+func TestSession_RedirectAllTo(t *testing.T) {
+	sender := &fakeSender{}
+	b := newTestBackend(&Config{GraphTimeout: time.Second, RedirectAllTo: "catchall@contoso.com"})
+	b.sender = sender
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("app@example.com", nil))
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "hidden@example.com"} {
+		require.NoError(t, c.Rcpt(rcpt, nil))
+	}
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("To: a@example.com\r\nCc: b@example.com\r\nSubject: staging\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Len(t, sender.messages, 1)
+	sent := sender.messages[0]
+	require.Len(t, sent.GetToRecipients(), 1)
+	assert.Equal(t, "catchall@contoso.com", *sent.GetToRecipients()[0].GetEmailAddress().GetAddress())
+	assert.Empty(t, sent.GetCcRecipients())
+	assert.Empty(t, sent.GetBccRecipients())
+	headers := map[string]string{}
+	for _, h := range sent.GetInternetMessageHeaders() {
+		headers[*h.GetName()] = *h.GetValue()
+	}
+	assert.Equal(t, "a@example.com", headers["X-Original-To"])
+	assert.Equal(t, "b@example.com", headers["X-Original-Cc"])
+	assert.Equal(t, "hidden@example.com", headers["X-Original-Bcc"])
+}
+
+func TestSession_MissingFrom(t *testing.T) {
+	send := func(policy string) (*fakeSender, error) {
+		sender := &fakeSender{}
+		b := newTestBackend(&Config{GraphTimeout: time.Second, SendOnBehalf: true, MissingFromPolicy: policy})
+		b.sender = sender
+		return sender, sendTestMessage(t, startTestServer(t, b), "user@example.com", "To: user@example.com\r\nSubject: cron\r\n\r\nbody\r\n")
+	}
+
+	// Sent as the mailbox, with no separate author
+	sender, err := send("default")
+	require.NoError(t, err)
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "bridge@example.com", sender.mailbox)
+	assert.Nil(t, sender.messages[0].GetFrom())
+	assert.Nil(t, sender.messages[0].GetSender())
+
+	// The envelope sender becomes the author
+	sender, err = send("envelope")
+	require.NoError(t, err)
+	require.Len(t, sender.messages, 1)
+	assert.Equal(t, "bridge@example.com", sender.mailbox)
+	assert.Equal(t, "sender@example.com", *sender.messages[0].GetFrom().GetEmailAddress().GetAddress())
+	assert.Equal(t, "bridge@example.com", *sender.messages[0].GetSender().GetEmailAddress().GetAddress())
+
+	sender, err = send("reject")
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 550, smtpErr.Code)
+	assert.Empty(t, sender.messages)
+}
+
+func TestSession_PartialBatchFailureQueuesRemainder(t *testing.T) {
+	config := &Config{GraphTimeout: time.Second, RecipientBatchSize: 1, QueueMaxRetries: 3}
+	b := newTestBackend(config)
+	sender := &recipientSender{fail: map[string]error{"busy@example.com": newODataError(503, "ServiceUnavailable")}}
+	b.sender = sender
+	q, err := newRetryQueue(config, b)
+	require.NoError(t, err)
+	b.queue = q
+	addr := startTestServer(t, b)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("app@example.com", nil))
+	require.NoError(t, c.Rcpt("ok@example.com", nil))
+	require.NoError(t, c.Rcpt("busy@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: report\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close(), "accepted, the failed batch is queued")
+
+	// Only the failed batch is queued; the delivered one is recorded as sent
+	entries := q.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, []string{"busy@example.com"}, entries[0].To)
+	statuses := map[string]string{}
+	for _, r := range entries[0].Recipients {
+		statuses[r.Address] = r.Status
+	}
+	assert.Equal(t, map[string]string{"ok@example.com": recipientSent, "busy@example.com": recipientPending}, statuses)
+
+	// The retry goes to the failed recipient only
+	delete(sender.fail, "busy@example.com")
+	q.deliver(q.items[entries[0].ID])
+	assert.Equal(t, []string{"ok@example.com", "busy@example.com"}, sender.sent)
+	assert.Empty(t, q.List())
+}
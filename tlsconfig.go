@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites maps cipher suite names (as in tls.CipherSuites) to IDs.
+// Only Go's secure suites are accepted. TLS 1.3 suites aren't configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// buildTLSConfig returns the STARTTLS configuration, or nil when no
+// certificate is configured.
+func buildTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	// Both were validated by loadConfig
+	suites, _ := parseCipherSuites(config.TLSCipherSuites)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[config.TLSMinVersion],
+		CipherSuites: suites,
+	}, nil
+}
+
+// buildHealthTLSConfig returns the health server's TLS configuration, or nil
+// for plain HTTP. An explicit health_tls_cert/health_tls_key pair wins;
+// otherwise health_tls reuses the Graph client certificate.
+func buildHealthTLSConfig(config *Config) (*tls.Config, error) {
+	var cert tls.Certificate
+	switch {
+	case config.HealthTLSCert != "":
+		var err error
+		cert, err = tls.LoadX509KeyPair(config.HealthTLSCert, config.HealthTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load health TLS certificate: %w", err)
+		}
+	case config.HealthTLS:
+		certs, key, err := loadClientCertificate(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range certs {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		cert.PrivateKey = key
+		cert.Leaf = certs[0]
+	default:
+		return nil, nil
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[config.TLSMinVersion],
+	}, nil
+}
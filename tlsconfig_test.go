@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate and key for localhost.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestStartTLS_MinVersion(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	config := &Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "1.3"}
+	b := newTestBackend(config)
+	var err error
+	b.tlsConfig, err = buildTLSConfig(config)
+	require.NoError(t, err)
+	addr := startTestServer(t, b)
+
+	old, err := smtp.DialStartTLS(addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		err = old.Noop() // the handshake happens on first use
+		old.Close()
+	}
+	assert.Error(t, err, "TLS 1.2 must be refused")
+
+	c, err := smtp.DialStartTLS(addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Noop()) // completes the handshake
+	state, ok := c.TLSConnectionState()
+	require.True(t, ok)
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, ids)
+
+	_, err = parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err)
+}
+
+func TestBuildHealthTLSConfig(t *testing.T) {
+	tlsConfig, err := buildHealthTLSConfig(&Config{})
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig, "plain HTTP by default")
+
+	certFile, keyFile := writeTestCert(t)
+	tlsConfig, err = buildHealthTLSConfig(&Config{HealthTLSCert: certFile, HealthTLSKey: keyFile, TLSMinVersion: "1.2"})
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.Certificates, 1)
+
+	// Without a dedicated pair, the Graph client certificate is reused
+	tlsConfig, err = buildHealthTLSConfig(&Config{HealthTLS: true, CertPEM: certFile, KeyPEM: keyFile, TLSMinVersion: "1.2"})
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, "localhost", tlsConfig.Certificates[0].Leaf.Subject.CommonName)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/emersion/go-smtp"
+)
+
+// presendRequest is the metadata POSTed to presend_webhook_url.
+type presendRequest struct {
+	From      string   `json:"from"`
+	Mailbox   string   `json:"mailbox"`
+	To        []string `json:"to"`
+	Cc        []string `json:"cc,omitempty"`
+	Bcc       []string `json:"bcc,omitempty"`
+	Subject   string   `json:"subject"`
+	SizeBytes int      `json:"size_bytes"`
+}
+
+var errPresendDenied = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected by approval policy",
+}
+
+var errPresendUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message approval service unavailable, try again later",
+}
+
+// approveMessage asks the pre-send webhook whether msg may be sent. A 200
+// approves and a 4xx denies. Anything else (timeouts, 5xx) is a webhook
+// failure, which lets the message through only with presend_webhook_fail_open.
+func (b *Backend) approveMessage(req *presendRequest, logger *slog.Logger) error {
+	url := b.config.PresendWebhookURL
+	if url == "" {
+		return nil
+	}
+
+	status, err := b.callPresendWebhook(url, req)
+	switch {
+	case err == nil && status == http.StatusOK:
+		return nil
+	case err == nil && status >= 400 && status < 500:
+		logger.Warn("Message denied by pre-send webhook", "status", status)
+		metrics.Inc("presend_denied_total", "Total messages denied by the pre-send webhook.")
+		return errPresendDenied
+	}
+
+	if err == nil {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	metrics.Inc("presend_errors_total", "Total pre-send webhook calls that failed.")
+	if b.config.PresendWebhookFailOpen {
+		logger.Warn("Pre-send webhook failed, sending anyway (fail-open)", "error", err)
+		return nil
+	}
+	logger.Error("Pre-send webhook failed, deferring message (fail-closed)", "error", err)
+	return errPresendUnavailable
+}
+
+func (b *Backend) callPresendWebhook(url string, req *presendRequest) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.PresendWebhookTimeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApproveMessage(t *testing.T) {
+	status := http.StatusOK
+	var got presendRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	b := newTestBackend(&Config{PresendWebhookURL: srv.URL, PresendWebhookTimeout: time.Second})
+	req := &presendRequest{From: "app@internal", To: []string{"user@example.com"}, Subject: "hi", SizeBytes: 42}
+
+	require.NoError(t, b.approveMessage(req, b.logger))
+	assert.Equal(t, 42, got.SizeBytes)
+	assert.Equal(t, []string{"user@example.com"}, got.To)
+
+	status = http.StatusForbidden
+	assert.Equal(t, errPresendDenied, b.approveMessage(req, b.logger))
+
+	// Webhook failures defer the message unless fail-open
+	status = http.StatusInternalServerError
+	assert.Equal(t, errPresendUnavailable, b.approveMessage(req, b.logger))
+	b.config.PresendWebhookFailOpen = true
+	assert.NoError(t, b.approveMessage(req, b.logger))
+}